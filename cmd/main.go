@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
 	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/proxy"
@@ -35,6 +36,10 @@ type config struct {
 	nsParserConf    string
 	thanosTokenFile string
 	nsLabelName     string
+	proxyConf       string
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+	proxyOpts       proxy.Options
 }
 
 func main() {
@@ -49,18 +54,62 @@ func main() {
 		"/var/run/secrets/kubernetes.io/serviceaccount/token",
 		"The token file passed to OCP thanos-querier service for authentication")
 	flagset.StringVar(&cfg.nsLabelName, "ns-label-name", "namespace", "The name of metrics' namespace label")
+	flagset.StringVar(&cfg.proxyConf, "proxy-conf", "", "Proxy policy configuration file location. No policy is applied if it is empty")
+	flagset.DurationVar(&cfg.shutdownDelay,
+		"shutdown-delay",
+		5*time.Second,
+		"How long to report not ready before shutting down, so that the Service stops sending traffic")
+	flagset.DurationVar(&cfg.shutdownTimeout,
+		"shutdown-timeout",
+		3*time.Minute,
+		"Maximum time to wait for in-flight requests to finish when shutting down. It should be longer than --upstream-timeout")
+	flagset.DurationVar(&cfg.proxyOpts.ReadTimeout,
+		"read-timeout",
+		30*time.Second,
+		"Maximum duration for reading the entire client request. 0 means no timeout")
+	flagset.DurationVar(&cfg.proxyOpts.WriteTimeout,
+		"write-timeout",
+		3*time.Minute,
+		"Maximum duration before timing out writes of the response. It should be longer than --upstream-timeout. 0 means no timeout")
+	flagset.DurationVar(&cfg.proxyOpts.IdleTimeout,
+		"idle-timeout",
+		2*time.Minute,
+		"Maximum amount of time to wait for the next request on a keep-alive connection. 0 means no timeout")
+	flagset.DurationVar(&cfg.proxyOpts.UpstreamResponseHeaderTimeout,
+		"upstream-response-header-timeout",
+		0,
+		"Maximum time to wait for thanos-querier response headers. 0 means no timeout")
+	flagset.DurationVar(&cfg.proxyOpts.UpstreamTimeout,
+		"upstream-timeout",
+		2*time.Minute,
+		"Deadline of requests forwarded to thanos-querier. The timeout parameter of client is capped by it. 0 means no timeout")
+	flagset.BoolVar(&cfg.proxyOpts.EnableExperimentalFunctions,
+		"enable-experimental-functions",
+		false,
+		"Allow PromQL functions which are experimental in Prometheus, e.g. info() and limitk(). thanos-querier must enable them too")
 
 	if err := flagset.Parse(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
+	if cfg.shutdownTimeout < cfg.proxyOpts.UpstreamTimeout {
+		log.Printf("--shutdown-timeout %v is shorter than --upstream-timeout %v, long queries may be cut when shutting down",
+			cfg.shutdownTimeout, cfg.proxyOpts.UpstreamTimeout)
+	}
+
 	nsparser := nsparser.NewNSParser(cfg.nsParserConf)
 	if nsparser == nil {
 		os.Exit(1)
 	}
+	proxyConfig, err := proxy.LoadConfig(cfg.proxyConf)
+	if err != nil {
+		log.Fatalf("failed to load proxy configuration file %s: %v", cfg.proxyConf, err)
+	}
+	cfg.proxyOpts.Config = proxyConfig
 	errCh := make(chan error)
-	server, err := proxy.StartAndServe(cfg.listeningAddr, cfg.urlPrefix, cfg.thanosAddr, cfg.thanosTokenFile, nsparser, cfg.nsLabelName, errCh)
+	server, err := proxy.StartAndServe(cfg.listeningAddr, cfg.urlPrefix, cfg.thanosAddr, cfg.thanosTokenFile, nsparser, cfg.nsLabelName, cfg.proxyOpts, errCh)
 	if err != nil {
+		log.Printf("Failed to start server: %v", err)
 		os.Exit(1)
 	}
 	term := make(chan os.Signal, 1)
@@ -68,7 +117,9 @@ func main() {
 	select {
 	case <-term:
 		log.Print("Received SIGTERM, exiting gracefully...")
-		server.Close()
+		if err := server.GracefulShutdown(cfg.shutdownDelay, cfg.shutdownTimeout); err != nil {
+			log.Printf("Server did not shut down gracefully: %v", err)
+		}
 	case err := <-errCh:
 		if err != http.ErrServerClosed {
 			log.Printf("Server stopped with %v", err)
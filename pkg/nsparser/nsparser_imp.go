@@ -38,6 +38,7 @@ type ibmCommonServiceNSParser struct {
 }
 type nsListParser struct {
 	namespaces []string
+	labels     Constraints
 }
 
 /**********************************************
@@ -51,6 +52,15 @@ func (p *nsListParser) ParseNamespaces(req *http.Request) ([]string, error) {
 	return copied, nil
 }
 
+//ParseConstraints get the label constraints for the request
+func (p *nsListParser) ParseConstraints(req *http.Request) (Constraints, error) {
+	copied := Constraints{}
+	for name, values := range p.labels {
+		copied[name] = append([]string{}, values...)
+	}
+	return copied, nil
+}
+
 //ParseNamespaces get the namespaces for the request
 func (p *ibmCommonServiceNSParser) ParseNamespaces(req *http.Request) ([]string, error) {
 	p.init()
@@ -59,7 +69,7 @@ func (p *ibmCommonServiceNSParser) ParseNamespaces(req *http.Request) ([]string,
 		return []string{}, err
 	}
 	var uid string
-	uid, err = p.getUserID(token)
+	uid, err = p.cachedUserID(req, token)
 	if err != nil {
 		return []string{}, err
 	}
@@ -71,10 +81,43 @@ func (p *ibmCommonServiceNSParser) ParseNamespaces(req *http.Request) ([]string,
 	return namespaces, nil
 }
 
+//ParseIdentity get the IAM user id of the caller
+func (p *ibmCommonServiceNSParser) ParseIdentity(req *http.Request) (Identity, error) {
+	p.init()
+	token, err := p.getToken(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	uid, err := p.cachedUserID(req, token)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{User: uid}, nil
+}
+
 /**********************************************
 ***** NSParser implementation: helper methods
 ***********************************************/
 
+//cachedUserID gets user id of token once per request, if request is created by WithRequestCache
+func (p *ibmCommonServiceNSParser) cachedUserID(req *http.Request, token string) (string, error) {
+	c, ok := req.Context().Value(requestCacheKey{}).(*requestCache)
+	if !ok {
+		return p.getUserID(token)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uid, ok := c.uids[token]; ok {
+		return uid, nil
+	}
+	uid, err := p.getUserID(token)
+	if err != nil {
+		return "", err
+	}
+	c.uids[token] = uid
+	return uid, nil
+}
+
 func (p *ibmCommonServiceNSParser) getUserID(token string) (string, error) {
 	targetURL := p.uidURL + "/v1/auth/userInfo"
 
@@ -17,9 +17,11 @@
 package nsparser
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/ghodss/yaml"
 )
@@ -41,12 +43,50 @@ type NSParser interface {
 	ParseNamespaces(req *http.Request) ([]string, error)
 }
 
+//Identity describes the caller of a request
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+//IdentityParser is implemented by namespace parsers which can also tell who the caller is
+type IdentityParser interface {
+	ParseIdentity(req *http.Request) (Identity, error)
+}
+
+//requestCacheKey is the context key of requestCache
+type requestCacheKey struct{}
+
+//requestCache holds what parsers resolve for one request, e.g. IAM user id by token
+type requestCache struct {
+	mu   sync.Mutex
+	uids map[string]string
+}
+
+//WithRequestCache returns ctx in which parsers remember what they resolve for a request,
+//so that e.g. ParseNamespaces and ParseIdentity of the same request ask IAM once
+func WithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey{}, &requestCache{uids: map[string]string{}})
+}
+
+//Constraints maps labels besides namespace label to the values accessible to the caller,
+//e.g. {cluster: [a], tenant: [x, y]}
+type Constraints map[string][]string
+
+//ConstraintParser is implemented by namespace parsers which also restrict labels besides namespace label
+type ConstraintParser interface {
+	ParseConstraints(req *http.Request) (Constraints, error)
+}
+
 //NewNSParser create NSParser instance according to configration file.
 //The configuration file should be in format:
 //type: typename
 //paras:
 //  pname1: pvalue1
 //  pname2: pvalue2
+//ns-list type of parser accepts the optional paras labels restricting labels besides namespace:
+//  labels:
+//    cluster: ["cluster1"]
 //only ibm-cs type of parser is implemented for now
 func NewNSParser(cfgFile string) NSParser {
 	b, err := ioutil.ReadFile(cfgFile)
@@ -92,7 +132,29 @@ func NewNSParser(cfgFile string) NSParser {
 			}
 
 		}
-		parser := nsListParser{namespaces}
+		labels := Constraints{}
+		if objs, ok := paras["labels"].(map[string]interface{}); ok {
+			for name, values := range objs {
+				list, ok := values.([]interface{})
+				if !ok {
+					log.Fatalf("something is wrong in namespace parser configuration file: " + cfgFile)
+					return nil
+				}
+				//empty list is kept, so that no value of label is accessible
+				labels[name] = []string{}
+				for _, v := range list {
+					value, ok := v.(string)
+					if !ok {
+						log.Fatalf("value %v of label %s is not a string in namespace parser configuration file: %s", v, name, cfgFile)
+						return nil
+					}
+					if value != "" {
+						labels[name] = append(labels[name], value)
+					}
+				}
+			}
+		}
+		parser := nsListParser{namespaces, labels}
 		log.Printf("namespace parser created. type: " + string(NSParserTypeNSList))
 		return &parser
 
@@ -0,0 +1,181 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+//extent is a cached matrix evaluated at every step from start to end
+type extent struct {
+	start   model.Time
+	end     model.Time
+	expires time.Time
+	result  *rangeResult
+}
+
+type cacheEntry struct {
+	key     string
+	extents []extent
+	size    int64
+}
+
+//resultsCache keeps matrices of range queries in memory. Entries are keyed by
+//query, namespaces and step, and hold extents which can be reused by
+//overlapping ranges. The least recently used entries are evicted first
+type resultsCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	maxSize int64
+	ttl     time.Duration
+	//maxFreshness is the age samples must reach before they are cached
+	maxFreshness time.Duration
+}
+
+func newResultsCache(cfg CacheConfig) *resultsCache {
+	ttl := time.Duration(cfg.TTL)
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	maxFreshness := time.Duration(cfg.MaxFreshness)
+	if maxFreshness <= 0 {
+		maxFreshness = 10 * time.Minute
+	}
+	return &resultsCache{
+		entries:      map[string]*list.Element{},
+		lru:          list.New(),
+		maxSize:      cfg.MaxSize,
+		ttl:          ttl,
+		maxFreshness: maxFreshness,
+	}
+}
+
+//get returns unexpired extents of key sorted by start
+func (c *resultsCache) get(key string) []extent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	var extents []extent
+	for _, e := range elem.Value.(*cacheEntry).extents {
+		if now.Before(e.expires) {
+			extents = append(extents, e)
+		}
+	}
+	return extents
+}
+
+//put merges extents into the entry of key. Extents of the same entry which
+//overlap or are adjacent by step are merged into one
+func (c *resultsCache) put(key string, step model.Time, extents []extent) {
+	if len(extents) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry := &cacheEntry{key: key}
+	if elem, ok := c.entries[key]; ok {
+		old := elem.Value.(*cacheEntry)
+		for _, e := range old.extents {
+			if now.Before(e.expires) {
+				extents = append(extents, e)
+			}
+		}
+		c.remove(elem)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].start < extents[j].start })
+	for _, e := range extents {
+		last := len(entry.extents) - 1
+		if last >= 0 && e.start <= entry.extents[last].end+step {
+			merged := &entry.extents[last]
+			if e.end > merged.end {
+				merged.end = e.end
+			}
+			if e.expires.Before(merged.expires) {
+				merged.expires = e.expires
+			}
+			merged.result = mergeResults(merged.result, e.result)
+			continue
+		}
+		entry.extents = append(entry.extents, e)
+	}
+	for _, e := range entry.extents {
+		entry.size += resultSize(e.result)
+	}
+	if entry.size > c.maxSize {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultsCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+//resultSize estimates memory used by the matrix
+func resultSize(res *rangeResult) int64 {
+	size := int64(0)
+	for _, s := range res.streams {
+		for name, value := range s.Metric {
+			size += int64(len(name) + len(value))
+		}
+		size += int64(len(s.Values)) * 16
+	}
+	return size
+}
+
+//missingRanges returns the ranges of [start, end] not covered by extents.
+//Extents must be sorted by start and aligned with start by step
+func missingRanges(start, end, step model.Time, extents []extent) [][2]model.Time {
+	var missing [][2]model.Time
+	cur := start
+	for _, e := range extents {
+		if e.end < cur {
+			continue
+		}
+		if e.start > end {
+			break
+		}
+		if e.start > cur {
+			missing = append(missing, [2]model.Time{cur, e.start - step})
+		}
+		cur = e.end + step
+	}
+	if cur <= end {
+		missing = append(missing, [2]model.Time{cur, end})
+	}
+	return missing
+}
@@ -0,0 +1,390 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+//stream returns series of job with samples at timestamps, valued by timestamp
+func stream(job string, timestamps ...model.Time) *model.SampleStream {
+	s := &model.SampleStream{Metric: model.Metric{"job": model.LabelValue(job)}}
+	for _, ts := range timestamps {
+		s.Values = append(s.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts)})
+	}
+	return s
+}
+
+//timestamps returns samples of result by job
+func timestamps(res *rangeResult) map[string][]model.Time {
+	got := map[string][]model.Time{}
+	for _, s := range res.streams {
+		for _, v := range s.Values {
+			got[string(s.Metric["job"])] = append(got[string(s.Metric["job"])], v.Timestamp)
+		}
+	}
+	return got
+}
+
+func TestMissingRanges(t *testing.T) {
+	ext := func(start, end model.Time) extent {
+		return extent{start: start, end: end}
+	}
+	cases := []struct {
+		name    string
+		start   model.Time
+		end     model.Time
+		extents []extent
+		want    [][2]model.Time
+	}{
+		{"no extent", 0, 100, nil, [][2]model.Time{{0, 100}}},
+		{"covered", 10, 90, []extent{ext(0, 100)}, nil},
+		{"exactly covered", 0, 100, []extent{ext(0, 100)}, nil},
+		{"head cached", 0, 100, []extent{ext(0, 50)}, [][2]model.Time{{60, 100}}},
+		{"tail cached", 0, 100, []extent{ext(50, 200)}, [][2]model.Time{{0, 40}}},
+		{"gap in the middle", 0, 100, []extent{ext(0, 30), ext(70, 100)}, [][2]model.Time{{40, 60}}},
+		{"adjacent extents", 0, 100, []extent{ext(0, 40), ext(50, 100)}, nil},
+		{"several gaps", 0, 100, []extent{ext(20, 30), ext(60, 70)}, [][2]model.Time{{0, 10}, {40, 50}, {80, 100}}},
+		{"extents outside", 30, 60, []extent{ext(0, 10), ext(80, 100)}, [][2]model.Time{{30, 60}}},
+		{"one point left", 0, 100, []extent{ext(0, 90)}, [][2]model.Time{{100, 100}}},
+	}
+	for _, c := range cases {
+		if got := missingRanges(c.start, c.end, 10, c.extents); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	cases := []struct {
+		name     string
+		start    model.Time
+		end      model.Time
+		step     model.Time
+		interval model.Time
+		want     [][2]model.Time
+	}{
+		{"within interval", 10, 50, 10, 100, [][2]model.Time{{10, 50}}},
+		{"aligned", 0, 250, 10, 100, [][2]model.Time{{0, 90}, {100, 190}, {200, 250}}},
+		{"unaligned start", 15, 215, 10, 100, [][2]model.Time{{15, 95}, {105, 195}, {205, 215}}},
+		{"step larger than interval", 0, 300, 150, 100, [][2]model.Time{{0, 0}, {150, 150}, {300, 300}}},
+		{"step not dividing interval", 0, 200, 30, 100, [][2]model.Time{{0, 90}, {120, 180}}},
+		{"single point", 40, 40, 10, 100, [][2]model.Time{{40, 40}}},
+	}
+	for _, c := range cases {
+		got := splitRange(c.start, c.end, c.step, c.interval)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+		//every point of the original query is evaluated exactly once
+		var points []model.Time
+		for _, p := range got {
+			if (p[0]-c.start)%c.step != 0 {
+				t.Errorf("%s: part %v is not aligned with start by step", c.name, p)
+			}
+			for ts := p[0]; ts <= p[1]; ts += c.step {
+				points = append(points, ts)
+			}
+		}
+		var want []model.Time
+		for ts := c.start; ts <= c.end; ts += c.step {
+			want = append(want, ts)
+		}
+		if !reflect.DeepEqual(points, want) {
+			t.Errorf("%s: parts evaluate %v, want %v", c.name, points, want)
+		}
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	a := &rangeResult{streams: []*model.SampleStream{stream("b", 0, 10), stream("a", 0, 10, 20)}, warnings: []string{"w1"}}
+	b := &rangeResult{streams: []*model.SampleStream{stream("a", 20, 30), stream("c", 30)}, warnings: []string{"w1", "w2"}}
+	c := &rangeResult{streams: []*model.SampleStream{stream("b", 40)}}
+	got := mergeResults(c, b, a)
+	want := map[string][]model.Time{"a": {0, 10, 20, 30}, "b": {0, 10, 40}, "c": {30}}
+	if !reflect.DeepEqual(timestamps(got), want) {
+		t.Errorf("got %v, want %v", timestamps(got), want)
+	}
+	var jobs []string
+	for _, s := range got.streams {
+		jobs = append(jobs, string(s.Metric["job"]))
+	}
+	if !reflect.DeepEqual(jobs, []string{"a", "b", "c"}) {
+		t.Errorf("series are not sorted: %v", jobs)
+	}
+	if !reflect.DeepEqual(got.warnings, []string{"w1", "w2"}) {
+		t.Errorf("got warnings %v", got.warnings)
+	}
+
+	trimmed := trimResult(got, 10, 30)
+	want = map[string][]model.Time{"a": {10, 20, 30}, "b": {10}, "c": {30}}
+	if !reflect.DeepEqual(timestamps(trimmed), want) {
+		t.Errorf("trimmed to %v, want %v", timestamps(trimmed), want)
+	}
+}
+
+func TestResultsCache(t *testing.T) {
+	c := newResultsCache(CacheConfig{MaxSize: 1 << 20})
+	expires := time.Now().Add(time.Hour)
+	ext := func(start, end model.Time) extent {
+		var ts []model.Time
+		for t := start; t <= end; t += 10 {
+			ts = append(ts, t)
+		}
+		return extent{start: start, end: end, expires: expires, result: &rangeResult{streams: []*model.SampleStream{stream("a", ts...)}}}
+	}
+	c.put("k", 10, []extent{ext(0, 50), ext(100, 150)})
+	c.put("k", 10, []extent{ext(40, 80)})
+	//adjacent by step
+	c.put("k", 10, []extent{ext(160, 200)})
+	extents := c.get("k")
+	if len(extents) != 2 {
+		t.Fatalf("got %d extents, want 2", len(extents))
+	}
+	wantRanges := [][2]model.Time{{0, 80}, {100, 200}}
+	for i, e := range extents {
+		if got := [2]model.Time{e.start, e.end}; got != wantRanges[i] {
+			t.Errorf("extent %d covers %v, want %v", i, got, wantRanges[i])
+		}
+		var want []model.Time
+		for ts := e.start; ts <= e.end; ts += 10 {
+			want = append(want, ts)
+		}
+		if got := timestamps(e.result)["a"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("extent %d holds %v, want %v", i, got, want)
+		}
+	}
+
+	//expired extents are not returned
+	old := ext(300, 400)
+	old.expires = time.Now().Add(-time.Second)
+	c.put("expired", 10, []extent{old})
+	if got := c.get("expired"); len(got) != 0 {
+		t.Errorf("got expired extents %v", got)
+	}
+
+	//the least recently used entries are evicted first
+	size := resultSize(ext(0, 50).result)
+	c = newResultsCache(CacheConfig{MaxSize: 2 * size})
+	c.put("k1", 10, []extent{ext(0, 50)})
+	c.put("k2", 10, []extent{ext(0, 50)})
+	c.get("k1")
+	c.put("k3", 10, []extent{ext(0, 50)})
+	for key, want := range map[string]bool{"k1": true, "k2": false, "k3": true} {
+		if got := len(c.get(key)) > 0; got != want {
+			t.Errorf("%s cached: %v, want %v", key, got, want)
+		}
+	}
+	if c.size > c.maxSize {
+		t.Errorf("cache size %d exceeds %d", c.size, c.maxSize)
+	}
+	//entries larger than the cache are not kept
+	c.put("large", 10, []extent{ext(0, 500)})
+	if got := c.get("large"); len(got) != 0 {
+		t.Error("entry larger than cache is kept")
+	}
+}
+
+//rangeUpstream returns a sample at every step of range queries, and records their parameters
+type rangeUpstream struct {
+	mu     sync.Mutex
+	params []url.Values
+}
+
+func (u *rangeUpstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	u.mu.Lock()
+	u.params = append(u.params, q)
+	u.mu.Unlock()
+	start, _ := parseTime(q.Get("start"))
+	end, _ := parseTime(q.Get("end"))
+	step, _ := parseDuration(q.Get("step"))
+	var ts []model.Time
+	for t := start; !t.After(end); t = t.Add(step) {
+		ts = append(ts, model.TimeFromUnixNano(t.UnixNano()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rangeResponse{
+		Status: "success",
+		Data:   rangeData{ResultType: model.ValMatrix.String(), Result: []*model.SampleStream{stream(q.Get("dedup"), ts...)}},
+	})
+}
+
+func (u *rangeUpstream) requests() []url.Values {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	res := u.params
+	u.params = nil
+	return res
+}
+
+//newRangeRoutes creates routes evaluating range queries by upstream
+func newRangeRoutes(t *testing.T, up http.Handler, cfg *Config) *routes {
+	server := httptest.NewServer(up)
+	t.Cleanup(server.Close)
+	return routesTo(t, server.URL, &cachedParser{namespaces: []string{"team-a"}}, cfg)
+}
+
+func TestQueryRangeParams(t *testing.T) {
+	up := &rangeUpstream{}
+	r := newRangeRoutes(t, up, &Config{
+		Cache: CacheConfig{MaxSize: 1 << 20, MaxFreshness: Duration(time.Minute)},
+		Split: SplitConfig{Interval: Duration(time.Hour)},
+	})
+	query := func(dedup string) *rangeResponse {
+		params := url.Values{
+			"query":                 {"up"},
+			"start":                 {"0"},
+			"end":                   {"7200"},
+			"step":                  {"60"},
+			"dedup":                 {dedup},
+			"partial_response":      {"false"},
+			"max_source_resolution": {"5m"},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var resp rangeResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return &resp
+	}
+
+	resp := query("true")
+	requests := up.requests()
+	//split at every hour
+	if len(requests) != 3 {
+		t.Fatalf("upstream got %d sub-queries, want 3", len(requests))
+	}
+	for _, q := range requests {
+		for k, want := range map[string]string{
+			"query":                 `up{namespace=~"^team-a$"}`,
+			"step":                  "60",
+			"dedup":                 "true",
+			"partial_response":      "false",
+			"max_source_resolution": "5m",
+		} {
+			if got := q.Get(k); got != want {
+				t.Errorf("sub-query got %s=%q, want %q", k, got, want)
+			}
+		}
+	}
+	if len(resp.Data.Result) != 1 || len(resp.Data.Result[0].Values) != 121 {
+		t.Errorf("got %v, want one series of 121 samples", resp.Data.Result)
+	}
+
+	query("true")
+	if got := up.requests(); len(got) != 0 {
+		t.Errorf("upstream got %d sub-queries for cached result", len(got))
+	}
+	//results of other parameters are not shared
+	resp = query("false")
+	if got := up.requests(); len(got) != 3 {
+		t.Errorf("upstream got %d sub-queries for query of other dedup, want 3", len(got))
+	}
+	if len(resp.Data.Result) != 1 || resp.Data.Result[0].Metric["job"] != "false" {
+		t.Errorf("got result %v of other dedup", resp.Data.Result)
+	}
+}
+
+func TestQueryRangeAtStartOrEnd(t *testing.T) {
+	up := &rangeUpstream{}
+	r := newRangeRoutes(t, up, &Config{
+		Cache: CacheConfig{MaxSize: 1 << 20, MaxFreshness: Duration(time.Minute)},
+		Split: SplitConfig{Interval: Duration(time.Hour)},
+	})
+	cases := []struct {
+		query string
+		//split tells whether query is split and cached
+		split bool
+	}{
+		{`up @ 3600`, true},
+		{`up @ start()`, false},
+		{`rate(up[5m] @ end())`, false},
+		{`max_over_time(up[10m:1m] @ start())`, false},
+	}
+	for _, c := range cases {
+		for i := 0; i < 2; i++ {
+			params := url.Values{"query": {c.query}, "start": {"0"}, "end": {"7200"}, "step": {"60"}}
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params.Encode(), nil)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d: %s", c.query, rec.Code, rec.Body)
+			}
+		}
+		requests := up.requests()
+		want := 2
+		if c.split {
+			//split at every hour, and cached the second time
+			want = 3
+		}
+		if len(requests) != want {
+			t.Errorf("%s: upstream got %d queries, want %d", c.query, len(requests), want)
+			continue
+		}
+		if !c.split {
+			for _, q := range requests {
+				if q.Get("start") != "0" || q.Get("end") != "7200" {
+					t.Errorf("%s: upstream got range %s to %s, want 0 to 7200", c.query, q.Get("start"), q.Get("end"))
+				}
+			}
+		}
+	}
+}
+
+//roundTripFunc is http.RoundTripper calling the function
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestEvalRangeCancelled(t *testing.T) {
+	r := newRangeRoutes(t, http.NotFoundHandler(), &Config{Split: SplitConfig{Interval: Duration(time.Minute), MaxParallel: 1}})
+	up := r.upstreams[defaultUpstreamName]
+	params := url.Values{"query": {"up"}, "step": {"15"}}
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		//the client disconnects while the first sub-query succeeds, so that
+		//the other sub-queries are skipped without error of their own
+		up.transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			cancel()
+			rec := httptest.NewRecorder()
+			(&rangeUpstream{}).ServeHTTP(rec, req)
+			return rec.Result(), nil
+		})
+		res, err := r.evalRange(ctx, up, params, 0, 3600*1000, 15*1000)
+		if err != context.Canceled {
+			t.Fatalf("got result %v, error %v of cancelled query, want %v", res, err, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//clusterSeparator separates cluster and namespace of cluster-qualified namespace, e.g. cluster1/team-a
+const clusterSeparator = "/"
+
+//namespaceGroup holds namespaces accessible in clusters. clusters is nil for
+//namespaces which are not qualified by cluster, i.e. accessible in every cluster
+type namespaceGroup struct {
+	clusters   []string
+	namespaces []string
+}
+
+//groupNamespaces groups cluster-qualified namespaces by clusters sharing the same namespaces,
+//so that each group can be expressed by one cluster matcher and one namespace matcher.
+//Namespaces which are not qualified by cluster are in the first group
+func groupNamespaces(namespaces []string) []namespaceGroup {
+	var unqualified []string
+	byCluster := map[string][]string{}
+	for _, ns := range namespaces {
+		i := strings.Index(ns, clusterSeparator)
+		if i < 0 {
+			unqualified = append(unqualified, ns)
+			continue
+		}
+		cluster := ns[:i]
+		byCluster[cluster] = append(byCluster[cluster], ns[i+len(clusterSeparator):])
+	}
+	var groups []namespaceGroup
+	if len(unqualified) > 0 {
+		groups = append(groups, namespaceGroup{namespaces: unqualified})
+	}
+	clusters := make([]string, 0, len(byCluster))
+	for cluster := range byCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	index := map[string]int{}
+	for _, cluster := range clusters {
+		nsList := byCluster[cluster]
+		sort.Strings(nsList)
+		key := strings.Join(nsList, ",")
+		if i, ok := index[key]; ok {
+			groups[i].clusters = append(groups[i].clusters, cluster)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, namespaceGroup{clusters: []string{cluster}, namespaces: nsList})
+	}
+	return groups
+}
+
+//branch returns enforcer restricting selectors to the namespaces of group. It returns
+//false if none of the clusters of group is allowed by the constraint of cluster label
+func (e *enforcer) branch(g namespaceGroup, clusterLabel string) (*enforcer, bool) {
+	b := *e
+	b.namespaces = g.namespaces
+	if g.clusters == nil {
+		return &b, true
+	}
+	b.constraints = nsparser.Constraints{}
+	for name, values := range e.constraints {
+		b.constraints[name] = values
+	}
+	clusters := g.clusters
+	if allowed, ok := b.constraints[clusterLabel]; ok {
+		clusters = nil
+		for _, c := range g.clusters {
+			if contains(allowed, c) {
+				clusters = append(clusters, c)
+			}
+		}
+	}
+	if len(clusters) == 0 {
+		return nil, false
+	}
+	b.constraints[clusterLabel] = clusters
+	return &b, true
+}
+
+//allowsNamespace tells whether namespace in cluster is accessible to the caller
+func (s *scope) allowsNamespace(cluster, namespace string) bool {
+	for _, ns := range s.namespaces {
+		switch ns {
+		case nsparser.AllNamespaces, namespace,
+			cluster + clusterSeparator + namespace,
+			cluster + clusterSeparator + nsparser.AllNamespaces:
+			return true
+		}
+	}
+	return false
+}
+
+//allowsCluster tells whether any namespace in cluster is accessible to the caller
+func (s *scope) allowsCluster(cluster string) bool {
+	for _, ns := range s.namespaces {
+		i := strings.Index(ns, clusterSeparator)
+		if ns == nsparser.AllNamespaces || i < 0 || ns[:i] == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+//expand restricts selectors of expr to the namespace groups of branches. The pairs of
+//cluster and namespace can not be expressed by one selector, so each selector is
+//duplicated for every branch and the duplicates are combined by or
+func expand(expr promparser.Expr, branches []*enforcer) (promparser.Expr, error) {
+	var err error
+	switch n := expr.(type) {
+	case *promparser.AggregateExpr:
+		if n.Expr, err = expand(n.Expr, branches); err != nil {
+			return nil, err
+		}
+		if n.Param != nil {
+			n.Param, err = expand(n.Param, branches)
+		}
+		return n, err
+
+	case *promparser.BinaryExpr:
+		if n.LHS, err = expand(n.LHS, branches); err != nil {
+			return nil, err
+		}
+		n.RHS, err = expand(n.RHS, branches)
+		return n, err
+
+	case *promparser.Call:
+		matrix := -1
+		for i, arg := range n.Args {
+			if _, ok := arg.(*promparser.MatrixSelector); ok {
+				matrix = i
+				continue
+			}
+			if n.Args[i], err = expand(arg, branches); err != nil {
+				return nil, err
+			}
+		}
+		if matrix < 0 {
+			return n, nil
+		}
+		//functions of range vector evaluate series one by one, so they are
+		//duplicated with their range vector selector
+		ms := n.Args[matrix].(*promparser.MatrixSelector)
+		vs, ok := ms.VectorSelector.(*promparser.VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("unexpected range vector selector %s", ms)
+		}
+		selectors, err := enforceBranches(vs, branches)
+		if err != nil {
+			return nil, err
+		}
+		calls := make([]promparser.Expr, 0, len(branches))
+		for _, vs := range selectors {
+			call := *n
+			call.Args = append(promparser.Expressions{}, n.Args...)
+			call.Args[matrix] = &promparser.MatrixSelector{VectorSelector: vs, Range: ms.Range}
+			calls = append(calls, &call)
+		}
+		if n.Func.Name == "absent_over_time" {
+			//series are absent only if they are absent in every branch
+			return combine(calls, promparser.LAND, &promparser.VectorMatching{Card: promparser.CardOneToOne, On: true}), nil
+		}
+		return combine(calls, promparser.LOR, &promparser.VectorMatching{Card: promparser.CardManyToMany}), nil
+
+	case *promparser.ParenExpr:
+		n.Expr, err = expand(n.Expr, branches)
+		return n, err
+
+	case *promparser.UnaryExpr:
+		n.Expr, err = expand(n.Expr, branches)
+		return n, err
+
+	case *promparser.SubqueryExpr:
+		n.Expr, err = expand(n.Expr, branches)
+		return n, err
+
+	case *promparser.StepInvariantExpr:
+		n.Expr, err = expand(n.Expr, branches)
+		return n, err
+
+	case *promparser.NumberLiteral, *promparser.StringLiteral, *promparser.DurationExpr:
+		return n, nil
+
+	case *promparser.MatrixSelector:
+		return nil, fmt.Errorf("range vector selector %s can not be restricted to cluster-qualified namespaces, use it in function", n)
+
+	case *promparser.VectorSelector:
+		selectors, err := enforceBranches(n, branches)
+		if err != nil {
+			return nil, err
+		}
+		exprs := make([]promparser.Expr, 0, len(selectors))
+		for _, vs := range selectors {
+			exprs = append(exprs, vs)
+		}
+		return combine(exprs, promparser.LOR, &promparser.VectorMatching{Card: promparser.CardManyToMany}), nil
+
+	default:
+		return nil, fmt.Errorf("unhandled node type %T", expr)
+	}
+}
+
+//enforceBranches returns copies of vs restricted by every branch. Denial is only returned
+//if every branch denies vs, as values denied by one branch may be accessible in another
+func enforceBranches(vs *promparser.VectorSelector, branches []*enforcer) ([]*promparser.VectorSelector, error) {
+	selectors := make([]*promparser.VectorSelector, 0, len(branches))
+	var denied error
+	allDenied := true
+	for _, b := range branches {
+		c := cloneSelector(vs)
+		if err := b.enforce(c); err != nil {
+			if denied == nil {
+				denied = err
+			}
+		} else {
+			allDenied = false
+		}
+		selectors = append(selectors, c)
+	}
+	if allDenied {
+		return nil, denied
+	}
+	return selectors, nil
+}
+
+//combine joins exprs by binary operator op into one parenthesized expression
+func combine(exprs []promparser.Expr, op promparser.ItemType, matching *promparser.VectorMatching) promparser.Expr {
+	res := exprs[0]
+	for _, expr := range exprs[1:] {
+		res = &promparser.BinaryExpr{Op: op, LHS: res, RHS: expr, VectorMatching: matching}
+	}
+	return &promparser.ParenExpr{Expr: res}
+}
+
+//cloneSelector copies selector so that its matchers can be changed independently
+func cloneSelector(vs *promparser.VectorSelector) *promparser.VectorSelector {
+	c := *vs
+	c.LabelMatchers = append([]*promlabels.Matcher{}, vs.LabelMatchers...)
+	return &c
+}
@@ -0,0 +1,109 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+func TestClusterEnforcer(t *testing.T) {
+	r := newTestRoutes(t, &cachedParser{}, &Config{})
+	up := r.upstreams[defaultUpstreamName]
+	noData := `namespace="` + noDataValue + `"`
+	cases := []struct {
+		name       string
+		namespaces []string
+		labels     nsparser.Constraints
+		want       string
+	}{
+		{"one cluster", []string{"c1/team-a"}, nil, `up{cluster=~"^c1$",namespace=~"^team-a$"}`},
+		{"allowed cluster", []string{"c1/team-a", "c2/team-b"}, nsparser.Constraints{"cluster": {"c2"}},
+			`up{cluster=~"^c2$",namespace=~"^team-b$"}`},
+		//empty intersection of clusters must not select every cluster
+		{"no allowed cluster", []string{"c1/team-a"}, nsparser.Constraints{"cluster": {"c2"}}, `up{cluster=~"^c2$",` + noData + `}`},
+		{"no allowed cluster of several", []string{"c1/team-a", "c2/team-b"}, nsparser.Constraints{"cluster": {"c3"}}, `up{cluster=~"^c3$",` + noData + `}`},
+		{"empty constraint", []string{"c1/team-a"}, nsparser.Constraints{"cluster": {}}, `up{cluster="` + noDataValue + `",` + noData + `}`},
+	}
+	for _, c := range cases {
+		e := r.enforcer(up, &scope{namespaces: c.namespaces, labels: c.labels, clusterLabel: "cluster"})
+		expr, err := promparser.ParseExpr("up")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr, err = e.inject(expr); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := expr.String(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestEmptyAllowedValues(t *testing.T) {
+	for _, query := range []string{`up`, `up{namespace="team-a"}`, `up{namespace=~""}`, `up{namespace!~".+"}`} {
+		for _, policy := range []string{deniedNoData, deniedNarrow, deniedError} {
+			expr, err := promparser.ParseExpr(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vs := expr.(*promparser.VectorSelector)
+			matchers, _ := restrictLabelMatcher(vs.LabelMatchers, "namespace", nil, policy)
+			if got := (&promparser.VectorSelector{Name: "up", LabelMatchers: matchers}).String(); got != `up{namespace="`+noDataValue+`"}` {
+				t.Errorf("%s with %s policy: got %s, want no data", query, policy, got)
+			}
+		}
+	}
+	if re := generateRegExpr(nil); re == "" || promlabels.MustNewMatcher(promlabels.MatchRegexp, "namespace", re).Matches("") {
+		t.Errorf("regular expression %q of no namespaces matches series without namespace", re)
+	}
+}
+
+func TestEmptyLabelConstraint(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ns-config.yaml")
+	conf := "type: ns-list\nparas:\n  namespaces: [team-a]\n  labels:\n    cluster: []\n"
+	if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := nsparser.NewNSParser(file)
+	labels, err := p.(nsparser.ConstraintParser).ParseConstraints(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the constraint must not disappear, as nothing would be restricted then
+	if values, ok := labels["cluster"]; !ok || len(values) != 0 {
+		t.Fatalf("got constraints %v, want empty cluster", labels)
+	}
+	r := newTestRoutes(t, p, &Config{})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {"up"}}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	want := `up{cluster="` + noDataValue + `",namespace=~"^team-a$"}`
+	if got := rec.Header().Get("X-Query"); rec.Code != http.StatusOK || got != want {
+		t.Errorf("status %d, upstream got %s, want %s", rec.Code, got, want)
+	}
+}
@@ -0,0 +1,421 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/prometheus/common/model"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//Config is the policy configuration of the proxy.
+//The configuration file should be in format:
+//identity:
+//  userHeader: X-Grafana-User
+//  groupsHeader: X-Forwarded-Groups
+//  trustHeaders: false
+//tenants:
+//  default:
+//    rateLimit: 10
+//    rateBurst: 20
+//    maxConcurrent: 4
+//    maxRange: 30d
+//    minStep: 15s
+//    maxPoints: 11000
+//    maxWindow: 1d
+//  users:
+//    user1:
+//      rateLimit: 50
+//  groups:
+//    group1:
+//      maxConcurrent: 10
+//denyList:
+//  functions: ["count_values"]
+//  selectorsWithoutName: true
+//  nameRegexp: true
+//upstreams:
+//- name: longterm
+//  url: https://thanos-longterm:9091
+//  tokenFile: /var/run/secrets/kubernetes.io/serviceaccount/token
+//  nsLabelName: namespace
+//  tls:
+//    caFile: /etc/tls/ca.crt
+//- name: default
+//  replicas: ["https://thanos-querier-1:9091"]
+//  retries: 2
+//  healthCheckPath: /-/healthy
+//routing:
+//- upstream: longterm
+//  olderThan: 14d
+//cache:
+//  maxSize: 268435456
+//  ttl: 1h
+//  maxFreshness: 10m
+//split:
+//  interval: 1d
+//  maxParallel: 4
+//api:
+//  globalEndpoints: ["/api/v1/status/buildinfo"]
+//  showUnscopedRules: false
+//  explain:
+//    enabled: true
+//    adminsOnly: false
+//enforcement:
+//  bypass:
+//  - metric: "node_.*"
+//  - selector: '{job="kube-state-metrics"}'
+//    label: exported_namespace
+//  labels:
+//  - metric: "otel_.*"
+//    label: k8s_namespace_name
+//  clusterLabel: cluster
+//  relabel: reject
+//  denied: error
+type Config struct {
+	Identity    IdentityConfig    `json:"identity"`
+	Tenants     TenantsConfig     `json:"tenants"`
+	DenyList    DenyListConfig    `json:"denyList"`
+	Upstreams   []UpstreamConfig  `json:"upstreams"`
+	Routing     []RoutingRule     `json:"routing"`
+	Cache       CacheConfig       `json:"cache"`
+	Split       SplitConfig       `json:"split"`
+	API         APIConfig         `json:"api"`
+	Enforcement EnforcementConfig `json:"enforcement"`
+}
+
+//IdentityConfig tells how to identify the caller when the namespace parser can not
+type IdentityConfig struct {
+	//UserHeader is the request header carrying the user name, e.g. X-Grafana-User
+	UserHeader string `json:"userHeader"`
+	//GroupsHeader is the request header carrying comma separated group names
+	GroupsHeader string `json:"groupsHeader"`
+	//TrustHeaders tells that the headers are set by a trusted front proxy, e.g. Grafana, so that
+	//they are read even for callers authenticated by namespace parser. Clients can set any header
+	TrustHeaders bool `json:"trustHeaders"`
+}
+
+//TenantsConfig holds the default tenant settings and the overrides per user and group
+type TenantsConfig struct {
+	Default TenantConfig            `json:"default"`
+	Users   map[string]TenantConfig `json:"users"`
+	Groups  map[string]TenantConfig `json:"groups"`
+}
+
+//TenantConfig holds settings applied to one tenant. Zero value means no limit
+type TenantConfig struct {
+	//RateLimit is the number of queries allowed per second
+	RateLimit float64 `json:"rateLimit"`
+	//RateBurst is the maximum number of queries allowed in a burst
+	RateBurst int `json:"rateBurst"`
+	//MaxConcurrent is the maximum number of queries running at the same time
+	MaxConcurrent int `json:"maxConcurrent"`
+	//MaxRange is the maximum duration between start and end of a range query
+	MaxRange Duration `json:"maxRange"`
+	//MinStep is the minimum step of a range query
+	MinStep Duration `json:"minStep"`
+	//MaxPoints is the maximum number of points per series of a range query
+	MaxPoints int64 `json:"maxPoints"`
+	//MaxWindow is the maximum range of range vector selectors and subqueries
+	MaxWindow Duration `json:"maxWindow"`
+}
+
+//DenyListConfig lists PromQL constructs which are rejected in queries of every caller
+type DenyListConfig struct {
+	//Functions are names of functions or aggregation operators which are not allowed
+	Functions []string `json:"functions"`
+	//NamespaceRelabel denies label_replace and label_join writing the namespace label.
+	//Deprecated: it is the same as Enforcement.Relabel reject, which is used if both are set
+	NamespaceRelabel bool `json:"namespaceRelabel"`
+	//SelectorsWithoutName denies selectors without metric name, e.g. {namespace="x"}
+	SelectorsWithoutName bool `json:"selectorsWithoutName"`
+	//NameRegexp denies regular expression matchers on metric name
+	NameRegexp bool `json:"nameRegexp"`
+}
+
+//UpstreamConfig describes a thanos-querier or prometheus service.
+//The upstream named default is configured by command line options,
+//and settings listed for it in configuration file are merged
+type UpstreamConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	//Replicas are addresses of endpoints equivalent to URL. They may only differ in scheme, host and port
+	Replicas []string `json:"replicas"`
+	//Retries is the number of times a failed read is retried on other endpoints
+	Retries int `json:"retries"`
+	//RetryBackoff is the wait before the first retry. It doubles on every retry. Default value is 100ms
+	RetryBackoff Duration `json:"retryBackoff"`
+	//HealthCheckPath is probed on every endpoint, e.g. /-/healthy. No health check if it is empty
+	HealthCheckPath string `json:"healthCheckPath"`
+	//HealthCheckInterval is the interval between health checks. Default value is 10s
+	HealthCheckInterval Duration `json:"healthCheckInterval"`
+	//TokenFile is the file of bearer token sent to upstream. No token is sent if it is empty
+	TokenFile string `json:"tokenFile"`
+	//NSLabelName is the name of metrics' namespace label. --ns-label-name is used if it is empty
+	NSLabelName string    `json:"nsLabelName"`
+	TLS         TLSConfig `json:"tls"`
+}
+
+//TLSConfig holds TLS settings used to connect to upstream
+type TLSConfig struct {
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+//RoutingRule picks upstream for requests meeting all of its conditions
+type RoutingRule struct {
+	//Upstream is name of the upstream requests are sent to
+	Upstream string `json:"upstream"`
+	//PathPrefix matches URL path of request
+	PathPrefix string `json:"pathPrefix"`
+	//Header matches requests having the header
+	Header string `json:"header"`
+	//HeaderValue matches requests having value of Header. Any value matches if it is empty
+	HeaderValue string `json:"headerValue"`
+	//OlderThan matches queries asking data older than the duration from now
+	OlderThan Duration `json:"olderThan"`
+}
+
+//CacheConfig configures in-memory cache of range query results
+type CacheConfig struct {
+	//MaxSize is the approximate maximum size of cached results in bytes. Cache is disabled if it is 0
+	MaxSize int64 `json:"maxSize"`
+	//TTL is how long a result is kept in cache. Default value is 1h
+	TTL Duration `json:"ttl"`
+	//MaxFreshness is the age samples must reach before they are cached,
+	//because recent samples may still change. Default value is 10m
+	MaxFreshness Duration `json:"maxFreshness"`
+}
+
+//SplitConfig configures splitting of long range queries
+type SplitConfig struct {
+	//Interval is the length of sub-queries, aligned to multiples of it. Splitting is disabled if it is 0
+	Interval Duration `json:"interval"`
+	//MaxParallel is the maximum number of sub-queries running at the same time. Default value is 4
+	MaxParallel int `json:"maxParallel"`
+}
+
+//APIConfig configures Prometheus HTTP API endpoints available to tenants
+type APIConfig struct {
+	//GlobalEndpoints are paths of endpoints which return data of no tenant
+	//and are forwarded for every caller, e.g. /api/v1/status/buildinfo.
+	//Default value is [/api/v1/status/buildinfo]
+	GlobalEndpoints []string `json:"globalEndpoints"`
+	//ShowUnscopedRules shows rules to tenants even if the namespaces selected by their queries can not be determined
+	ShowUnscopedRules bool `json:"showUnscopedRules"`
+	//Explain configures /-/explain which shows how queries of the caller are rewritten
+	Explain ExplainConfig `json:"explain"`
+}
+
+//ExplainConfig configures the debug endpoint /-/explain
+type ExplainConfig struct {
+	//Enabled serves the endpoint. It is disabled by default
+	Enabled bool `json:"enabled"`
+	//AdminsOnly limits the endpoint to callers who can access all namespaces
+	AdminsOnly bool `json:"adminsOnly"`
+}
+
+//defaultGlobalEndpoints are needed by Grafana to test the datasource
+var defaultGlobalEndpoints = []string{"/api/v1/status/buildinfo"}
+
+func (c APIConfig) globalEndpoints() []string {
+	if c.GlobalEndpoints == nil {
+		return defaultGlobalEndpoints
+	}
+	return c.GlobalEndpoints
+}
+
+//EnforcementConfig configures how namespaces are injected into selectors of queries
+type EnforcementConfig struct {
+	//Bypass lists selectors which are not restricted by namespace label.
+	//The first matching rule applies
+	Bypass []BypassRule `json:"bypass"`
+	//Labels maps metrics to the label carrying their namespace, e.g. exported_namespace.
+	//The first matching mapping applies. Other metrics use namespace label of upstream
+	Labels []LabelMapping `json:"labels"`
+	//ClusterLabel is the label carrying cluster of cluster-qualified namespaces, e.g. cluster1/team-a.
+	//Default value: cluster
+	ClusterLabel string `json:"clusterLabel"`
+	//Relabel is the policy for label_replace, label_join and count_values writing enforced labels:
+	//allow, reject, or rewrite to write exported_<label> instead. Default value: allow
+	Relabel string `json:"relabel"`
+	//Denied is the policy for selectors of namespaces which are not accessible to the caller:
+	//nodata to select no series, error to reject the query, or narrow to select accessible
+	//namespaces only. Default value: nodata
+	Denied string `json:"denied"`
+}
+
+//policies for label_replace, label_join and count_values writing enforced labels
+const (
+	relabelAllow   = "allow"
+	relabelReject  = "reject"
+	relabelRewrite = "rewrite"
+)
+
+//relabelPolicy returns the policy for label_replace, label_join and count_values writing enforced labels
+func (c *Config) relabelPolicy() (string, error) {
+	switch c.Enforcement.Relabel {
+	case relabelAllow, relabelReject, relabelRewrite:
+		return c.Enforcement.Relabel, nil
+	case "":
+		if c.DenyList.NamespaceRelabel {
+			return relabelReject, nil
+		}
+		return relabelAllow, nil
+	}
+	return "", fmt.Errorf("unknown relabel policy %q", c.Enforcement.Relabel)
+}
+
+//policies for selectors of namespaces which are not accessible
+const (
+	deniedNoData = "nodata"
+	deniedError  = "error"
+	deniedNarrow = "narrow"
+)
+
+//deniedPolicy returns the policy for selectors of namespaces which are not accessible
+func (c *Config) deniedPolicy() (string, error) {
+	switch c.Enforcement.Denied {
+	case deniedNoData, deniedError, deniedNarrow:
+		return c.Enforcement.Denied, nil
+	case "":
+		return deniedNoData, nil
+	}
+	return "", fmt.Errorf("unknown denied namespaces policy %q", c.Enforcement.Denied)
+}
+
+const defaultClusterLabel = "cluster"
+
+func (c EnforcementConfig) clusterLabel() string {
+	if c.ClusterLabel == "" {
+		return defaultClusterLabel
+	}
+	return c.ClusterLabel
+}
+
+//LabelMapping maps metrics to the label carrying their namespace
+type LabelMapping struct {
+	//Metric is regular expression fully matching metric name, e.g. kube_.*
+	Metric string `json:"metric"`
+	//Label carries namespace of the metrics, e.g. exported_namespace
+	Label string `json:"label"`
+}
+
+//BypassRule matches selectors by metric name or label matchers
+type BypassRule struct {
+	//Metric is regular expression fully matching metric name, e.g. node_.*
+	Metric string `json:"metric"`
+	//Selector is label selector whose matchers must all be present in selector of query, e.g. {job="node-exporter"}
+	Selector string `json:"selector"`
+	//Label is enforced instead of namespace label, e.g. exported_namespace.
+	//Selector is not restricted at all if it is empty
+	Label string `json:"label"`
+}
+
+//Duration is time.Duration written in Prometheus format in configuration file, e.g. 5m, 1d
+type Duration time.Duration
+
+//UnmarshalJSON parses Prometheus duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	md, err := model.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(md)
+	return nil
+}
+
+//MarshalJSON writes Prometheus duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(model.Duration(d).String())
+}
+
+//LoadConfig reads proxy configuration file.
+//Empty file name means default configuration without any policy
+func LoadConfig(cfgFile string) (*Config, error) {
+	cfg := &Config{}
+	if cfgFile == "" {
+		return cfg, nil
+	}
+	b, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//hasTenants tells whether any tenant setting is configured, i.e. whether callers need to be identified
+func (c *Config) hasTenants() bool {
+	return c.Tenants.Default != (TenantConfig{}) || len(c.Tenants.Users) > 0 || len(c.Tenants.Groups) > 0
+}
+
+//tenant returns settings of the caller. Settings of groups and of the user override default
+//settings field by field, so that an entry only changes the limits it sets. User settings take
+//precedence over settings of groups, and earlier groups of the caller over later ones
+func (c *Config) tenant(id nsparser.Identity) TenantConfig {
+	t := c.Tenants.Default
+	for i := len(id.Groups) - 1; i >= 0; i-- {
+		if g, ok := c.Tenants.Groups[id.Groups[i]]; ok {
+			t = t.override(g)
+		}
+	}
+	if u, ok := c.Tenants.Users[id.User]; ok && id.User != "" {
+		t = t.override(u)
+	}
+	return t
+}
+
+//override returns t with the fields set in o
+func (t TenantConfig) override(o TenantConfig) TenantConfig {
+	if o.RateLimit != 0 {
+		t.RateLimit = o.RateLimit
+	}
+	if o.RateBurst != 0 {
+		t.RateBurst = o.RateBurst
+	}
+	if o.MaxConcurrent != 0 {
+		t.MaxConcurrent = o.MaxConcurrent
+	}
+	if o.MaxRange != 0 {
+		t.MaxRange = o.MaxRange
+	}
+	if o.MinStep != 0 {
+		t.MinStep = o.MinStep
+	}
+	if o.MaxPoints != 0 {
+		t.MaxPoints = o.MaxPoints
+	}
+	if o.MaxWindow != 0 {
+		t.MaxWindow = o.MaxWindow
+	}
+	return t
+}
@@ -0,0 +1,49 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//error types used in Prometheus-style error response
+const (
+	errorBadData         = "bad_data"
+	errorTimeout         = "timeout"
+	errorUnavailable     = "unavailable"
+	errorForbidden       = "forbidden"
+	errorTooManyRequests = "too_many_requests"
+)
+
+//apiError is the error response body of Prometheus HTTP API
+type apiError struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+//writeError responds with Prometheus-style error JSON so that Grafana can show the reason
+func writeError(w http.ResponseWriter, code int, errorType string, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(apiError{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     msg,
+	})
+}
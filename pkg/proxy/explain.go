@@ -0,0 +1,173 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//report collects how selectors of a query are restricted
+type report struct {
+	selectors []selectorReport
+}
+
+//selectorReport tells how one selector is restricted
+type selectorReport struct {
+	//Selector is the selector before injection
+	Selector string `json:"selector"`
+	//Rewritten is the selector sent to upstream
+	Rewritten string `json:"rewritten"`
+	//Label is the label carrying namespace of the selector. It is empty if selector is bypassed
+	Label    string `json:"label,omitempty"`
+	Bypassed bool   `json:"bypassed"`
+	//NoData tells whether no data matcher is injected. Reasons tell which values are
+	//not accessible, they are dropped from selector if NoData is false
+	NoData  bool     `json:"noData"`
+	Reasons []string `json:"reasons,omitempty"`
+	denials []*denial
+}
+
+//add records selector restricted to vs. Nothing is recorded if report is not collected
+func (rep *report) add(selector string, vs *promparser.VectorSelector, label string, denials []*denial) {
+	if rep == nil {
+		return
+	}
+	r := selectorReport{
+		Selector:  selector,
+		Rewritten: vs.String(),
+		Label:     label,
+		Bypassed:  label == "",
+		denials:   denials,
+	}
+	for _, d := range denials {
+		r.NoData = r.NoData || !d.narrowed
+		r.Reasons = append(r.Reasons, d.Error())
+	}
+	rep.selectors = append(rep.selectors, r)
+}
+
+//droppedHeader is the response header listing values dropped from narrowed selectors
+const droppedHeader = "X-Ocpthanos-Proxy-Dropped"
+
+//dropped returns values dropped from narrowed selectors as matchers, e.g. namespace="team-c".
+//Values dropped from evaluated matchers, e.g. namespace=~"team-.*", can not be listed
+func (rep *report) dropped() []string {
+	var res []string
+	for _, s := range rep.selectors {
+		for _, d := range s.denials {
+			if !d.narrowed {
+				continue
+			}
+			for _, v := range d.values {
+				m := (&promlabels.Matcher{Type: promlabels.MatchEqual, Name: d.label, Value: v}).String()
+				if !contains(res, m) {
+					res = append(res, m)
+				}
+			}
+		}
+	}
+	return res
+}
+
+//collect makes enforcer and its branches record restricted selectors into rep
+func (e *enforcer) collect(rep *report) {
+	e.report = rep
+	for _, b := range e.branches {
+		b.report = rep
+	}
+}
+
+//explanation is the data returned by /-/explain
+type explanation struct {
+	Upstream     string               `json:"upstream"`
+	Namespaces   []string             `json:"namespaces"`
+	Labels       nsparser.Constraints `json:"labels,omitempty"`
+	Unrestricted bool                 `json:"unrestricted"`
+	Query        string               `json:"query"`
+	//Rewritten is the query sent to upstream. It is empty if query is rejected
+	Rewritten string `json:"rewritten,omitempty"`
+	//Error tells why query is rejected
+	Error     string           `json:"error,omitempty"`
+	Selectors []selectorReport `json:"selectors"`
+}
+
+//explain shows how query of the caller is rewritten without sending it to upstream
+func (r *routes) explain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.NotFound(w, req)
+		return
+	}
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	if r.opts.Config.API.Explain.AdminsOnly && !s.unrestricted() {
+		writeError(w, http.StatusForbidden, errorForbidden,
+			"/-/explain is not available to users who can not access all namespaces")
+		return
+	}
+	query := req.URL.Query().Get("query")
+	if query == "" {
+		writeError(w, http.StatusBadRequest, errorBadData, "query parameter is required")
+		return
+	}
+	expr, err := promparser.ParseExpr(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	up := r.upstreamFor(req)
+	res := explanation{
+		Upstream:     up.name,
+		Namespaces:   s.namespaces,
+		Labels:       s.labels,
+		Unrestricted: s.unrestricted(),
+		Query:        query,
+		Selectors:    []selectorReport{},
+	}
+	_, tenant := r.tenant(req, s)
+	err = checkQueryCost(req, expr, tenant)
+	if err == nil {
+		err = checkDenyList(expr, r.opts.Config.DenyList)
+	}
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case s.unrestricted():
+		res.Rewritten = expr.String()
+	default:
+		rep := &report{}
+		e := r.enforcer(up, s)
+		e.collect(rep)
+		if expr, err = e.inject(expr); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Rewritten = expr.String()
+		}
+		if rep.selectors != nil {
+			res.Selectors = rep.selectors
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: res})
+}
@@ -0,0 +1,175 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//outcomes of an attempt to send request to upstream endpoint
+const (
+	outcomeSuccess     = "success"
+	outcomeError       = "error"
+	outcomeServerError = "server_error"
+)
+
+//endpoint is one of the equivalent replicas of an upstream
+type endpoint struct {
+	url     *url.URL
+	healthy int32
+}
+
+func (ep *endpoint) isHealthy() bool {
+	return atomic.LoadInt32(&ep.healthy) == 1
+}
+
+//failoverTransport sends requests to healthy endpoints of upstream in turn,
+//and retries idempotent reads on other endpoints when they fail or return 5xx
+type failoverTransport struct {
+	upstream  string
+	endpoints []*endpoint
+	transport http.RoundTripper
+	retries   int
+	backoff   time.Duration
+	next      uint32
+}
+
+//RoundTrip implements http.RoundTripper
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	retries := t.retries
+	if !isIdempotent(req) {
+		retries = 0
+	}
+	candidates := t.candidates()
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		ep := candidates[attempt%len(candidates)]
+		resp, err := t.transport.RoundTrip(withEndpoint(req, ep, body))
+		outcome := outcomeSuccess
+		switch {
+		case err != nil:
+			outcome = outcomeError
+		case resp.StatusCode/100 == 5:
+			outcome = outcomeServerError
+		}
+		upstreamAttempts.WithLabelValues(t.upstream, ep.url.Host, outcome).Inc()
+		if outcome == outcomeSuccess {
+			return resp, nil
+		}
+		if err != nil {
+			log.Printf("attempt %d to upstream %s endpoint %s failed: %v", attempt+1, t.upstream, ep.url.Host, err)
+		} else {
+			log.Printf("attempt %d to upstream %s endpoint %s failed: status %s", attempt+1, t.upstream, ep.url.Host, resp.Status)
+		}
+		if attempt >= retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+//candidates returns endpoints in the order they are tried: healthy endpoints
+//first, starting from the next one in turn, then the unhealthy ones
+func (t *failoverTransport) candidates() []*endpoint {
+	start := int(atomic.AddUint32(&t.next, 1)) % len(t.endpoints)
+	var healthy, unhealthy []*endpoint
+	for i := range t.endpoints {
+		ep := t.endpoints[(start+i)%len(t.endpoints)]
+		if ep.isHealthy() {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+//healthCheck probes every endpoint periodically with path, e.g. /-/healthy
+func (t *failoverTransport) healthCheck(path string, interval time.Duration, director func(*http.Request)) {
+	for {
+		for _, ep := range t.endpoints {
+			healthy := int32(0)
+			req, err := http.NewRequest(http.MethodGet, "", nil)
+			if err == nil {
+				req.URL.Path = path
+				director(req)
+				resp, err := t.transport.RoundTrip(withEndpoint(req, ep, nil))
+				if err == nil {
+					_, _ = io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode/100 == 2 {
+						healthy = 1
+					}
+				}
+			}
+			if atomic.SwapInt32(&ep.healthy, healthy) != healthy {
+				log.Printf("upstream %s endpoint %s healthy: %v", t.upstream, ep.url.Host, healthy == 1)
+			}
+			upstreamEndpointUp.WithLabelValues(t.upstream, ep.url.Host).Set(float64(healthy))
+		}
+		time.Sleep(interval)
+	}
+}
+
+//withEndpoint copies request and sends it to endpoint
+func withEndpoint(req *http.Request, ep *endpoint, body []byte) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = ep.url.Scheme
+	r.URL.Host = ep.url.Host
+	r.Host = ep.url.Host
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return r
+}
+
+//isIdempotent tells whether request can be retried. POST is only used to read in Prometheus HTTP API
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return strings.Contains(req.URL.Path, "/api/v1/") && !strings.Contains(req.URL.Path, "/admin/")
+	}
+	return false
+}
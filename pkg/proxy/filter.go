@@ -0,0 +1,125 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+//apiResponse is the response body of Prometheus HTTP API. Data is kept as
+//generic JSON so that fields unknown to the proxy are passed on as they are
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+//filterResponse forwards request to upstream, and filters data of the successful
+//response with filter before it is returned to client. Failed response is passed on
+func filterResponse(w http.ResponseWriter, req *http.Request, up *upstream, filter func(data interface{}) interface{}) {
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	//response body is parsed, so it must not be compressed
+	outReq.Header.Del("Accept-Encoding")
+	resp, err := up.do(outReq)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	var parsed apiResponse
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &parsed) != nil || parsed.Status != "success" {
+		writeFetchError(w, &upstreamError{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body})
+		return
+	}
+	parsed.Data = filter(parsed.Data)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(parsed)
+}
+
+//targets filters active targets by namespace label, and dropped targets by
+//the namespace they are discovered in
+func (r *routes) targets(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	up := r.upstreamFor(req)
+	if s.unrestricted() {
+		up.handler.ServeHTTP(w, req)
+		return
+	}
+	filterResponse(w, req, up, func(data interface{}) interface{} {
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return data
+		}
+		obj["activeTargets"] = filterItems(obj["activeTargets"], func(item map[string]interface{}) bool {
+			return s.allows(up.nsLabelName, labelsOf(item["labels"]))
+		})
+		obj["droppedTargets"] = filterItems(obj["droppedTargets"], func(item map[string]interface{}) bool {
+			return s.allows("__meta_kubernetes_namespace", labelsOf(item["discoveredLabels"]))
+		})
+		return obj
+	})
+}
+
+//filterExemplars drops exemplars of series from other namespaces. The label carrying namespace
+//of series is chosen by e. The query is already limited to namespaces, this makes sure no exemplar leaks
+func filterExemplars(w http.ResponseWriter, req *http.Request, up *upstream, s *scope, e *enforcer) {
+	filterResponse(w, req, up, func(data interface{}) interface{} {
+		return filterItems(data, func(series map[string]interface{}) bool {
+			labels := labelsOf(series["seriesLabels"])
+			return s.allows(e.seriesLabel(labels), labels)
+		})
+	})
+}
+
+//filterItems keeps the objects of JSON array items which keep returns true for
+func filterItems(items interface{}, keep func(item map[string]interface{}) bool) []interface{} {
+	list, _ := items.([]interface{})
+	filtered := []interface{}{}
+	for _, item := range list {
+		if obj, ok := item.(map[string]interface{}); ok && keep(obj) {
+			filtered = append(filtered, obj)
+		}
+	}
+	return filtered
+}
+
+//labelValue returns value of label in JSON object labels
+func labelValue(labels interface{}, name string) string {
+	obj, _ := labels.(map[string]interface{})
+	value, _ := obj[name].(string)
+	return value
+}
+
+//labelsOf returns function looking up values of JSON object labels
+func labelsOf(labels interface{}) func(name string) string {
+	return func(name string) string {
+		return labelValue(labels, name)
+	}
+}
@@ -0,0 +1,231 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//apiResponses are responses of the Prometheus HTTP API endpoints holding entries of team-a and team-b
+var apiResponses = map[string]string{
+	"/api/v1/targets": `{"status":"success","data":{
+		"activeTargets":[{"labels":{"namespace":"team-a","job":"a"}},{"labels":{"namespace":"team-b","job":"b"}},{"labels":{"job":"node"}}],
+		"droppedTargets":[{"discoveredLabels":{"__meta_kubernetes_namespace":"team-a"}},{"discoveredLabels":{"__meta_kubernetes_namespace":"team-b"}}]}}`,
+	"/api/v1/alerts": `{"status":"success","data":{"alerts":[
+		{"labels":{"alertname":"A","namespace":"team-a"}},{"labels":{"alertname":"B","namespace":"team-b"}},{"labels":{"alertname":"C"}}]}}`,
+	"/api/v1/rules": `{"status":"success","data":{"groups":[
+		{"name":"g1","rules":[
+			{"name":"a","query":"up{namespace=\"team-a\"} == 0","alerts":[{"labels":{"namespace":"team-a"}},{"labels":{"namespace":"team-b"}}]},
+			{"name":"ab","query":"up{namespace=~\"team-a|team-b\"} == 0"},
+			{"name":"unscoped","query":"sum(up) == 0"},
+			{"name":"recording","query":"sum by (job) (up{namespace=\"team-a\"})"}]},
+		{"name":"g2","rules":[{"name":"b","query":"up{namespace=\"team-b\"} == 0"}]}]}}`,
+	"/api/v1/query_exemplars": `{"status":"success","data":[
+		{"seriesLabels":{"__name__":"x","namespace":"team-a"},"exemplars":[{"value":"1"}]},
+		{"seriesLabels":{"__name__":"x","namespace":"team-b"},"exemplars":[{"value":"2"}]}]}`,
+	"/api/v1/metadata": `{"status":"success","data":{
+		"up":[{"type":"gauge"}],"x":[{"type":"counter"}],"node_load1":[{"type":"gauge"}]}}`,
+}
+
+//newAPIRoutes creates routes forwarding to upstream which responds with apiResponses.
+//Metric names are looked up in metrics by the namespace selected by match[]
+func newAPIRoutes(t *testing.T, namespaces []string, cfg *Config, metrics map[string][]string) *routes {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/api/v1/label/__name__/values" {
+			names := []string{}
+			for selector, list := range metrics {
+				if contains(req.URL.Query()["match[]"], selector) {
+					names = append(names, list...)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: names})
+			return
+		}
+		fmt.Fprint(w, apiResponses[req.URL.Path])
+	}))
+	t.Cleanup(upstream.Close)
+	return routesTo(t, upstream.URL, &cachedParser{namespaces: namespaces}, cfg)
+}
+
+//getData requests path and returns data of the response
+func getData(t *testing.T, r *routes, path string) interface{} {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", path, rec.Code, rec.Body)
+	}
+	var resp apiResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data
+}
+
+//fieldValues returns values of field of the objects in JSON array items
+func fieldValues(items interface{}, field func(item map[string]interface{}) string) []string {
+	values := []string{}
+	for _, item := range items.([]interface{}) {
+		values = append(values, field(item.(map[string]interface{})))
+	}
+	return values
+}
+
+func labelField(field, name string) func(item map[string]interface{}) string {
+	return func(item map[string]interface{}) string {
+		return labelValue(item[field], name)
+	}
+}
+
+func TestFilterResponses(t *testing.T) {
+	r := newAPIRoutes(t, []string{"team-a"}, &Config{}, nil)
+
+	targets := getData(t, r, "/api/v1/targets").(map[string]interface{})
+	if got := fieldValues(targets["activeTargets"], labelField("labels", "job")); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got active targets %v, want [a]", got)
+	}
+	dropped := fieldValues(targets["droppedTargets"], labelField("discoveredLabels", "__meta_kubernetes_namespace"))
+	if !reflect.DeepEqual(dropped, []string{"team-a"}) {
+		t.Errorf("got dropped targets %v, want [team-a]", dropped)
+	}
+
+	alerts := getData(t, r, "/api/v1/alerts").(map[string]interface{})
+	if got := fieldValues(alerts["alerts"], labelField("labels", "alertname")); !reflect.DeepEqual(got, []string{"A"}) {
+		t.Errorf("got alerts %v, want [A]", got)
+	}
+
+	exemplars := getData(t, r, "/api/v1/query_exemplars?query=x")
+	if got := fieldValues(exemplars, labelField("seriesLabels", "namespace")); !reflect.DeepEqual(got, []string{"team-a"}) {
+		t.Errorf("got exemplars of %v, want [team-a]", got)
+	}
+
+	//everything is returned to users who can access all namespaces
+	admin := newAPIRoutes(t, []string{"ALL"}, &Config{}, nil)
+	alerts = getData(t, admin, "/api/v1/alerts").(map[string]interface{})
+	if got := fieldValues(alerts["alerts"], labelField("labels", "alertname")); !reflect.DeepEqual(got, []string{"A", "B", "C"}) {
+		t.Errorf("got alerts %v for admin, want [A B C]", got)
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	name := func(item map[string]interface{}) string {
+		return item["name"].(string)
+	}
+	cases := []struct {
+		showUnscoped bool
+		want         []string
+	}{
+		{false, []string{"a", "recording"}},
+		{true, []string{"a", "unscoped", "recording"}},
+	}
+	for _, c := range cases {
+		r := newAPIRoutes(t, []string{"team-a"}, &Config{API: APIConfig{ShowUnscopedRules: c.showUnscoped}}, nil)
+		groups := getData(t, r, "/api/v1/rules").(map[string]interface{})["groups"]
+		if got := fieldValues(groups, name); !reflect.DeepEqual(got, []string{"g1"}) {
+			t.Errorf("showUnscopedRules %v: got groups %v, want [g1]", c.showUnscoped, got)
+			continue
+		}
+		rules := groups.([]interface{})[0].(map[string]interface{})["rules"]
+		if got := fieldValues(rules, name); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("showUnscopedRules %v: got rules %v, want %v", c.showUnscoped, got, c.want)
+		}
+		alerts := rules.([]interface{})[0].(map[string]interface{})["alerts"]
+		if got := fieldValues(alerts, labelField("labels", "namespace")); !reflect.DeepEqual(got, []string{"team-a"}) {
+			t.Errorf("got alerts of %v, want [team-a]", got)
+		}
+	}
+}
+
+func TestFilterMetadata(t *testing.T) {
+	metrics := map[string][]string{
+		`{namespace=~"^team-a$"}`: {"up"},
+		`{namespace=~"^team-b$"}`: {"x"},
+	}
+	r := newAPIRoutes(t, []string{"team-a"}, &Config{}, metrics)
+	data := getData(t, r, "/api/v1/metadata").(map[string]interface{})
+	var got []string
+	for name := range data {
+		got = append(got, name)
+	}
+	if !reflect.DeepEqual(got, []string{"up"}) {
+		t.Errorf("got metadata of %s, want [up]", strings.Join(got, ","))
+	}
+}
+
+func TestFilterWithLabelMapping(t *testing.T) {
+	cfg := &Config{Enforcement: EnforcementConfig{
+		Labels: []LabelMapping{{Metric: "otel_.*", Label: "k8s_namespace_name"}},
+		Bypass: []BypassRule{{Metric: "node_.*"}},
+	}}
+	metrics := map[string][]string{
+		`{__name__=~"^(?:node_.*)$"}`:                                {"node_load1"},
+		`{__name__=~"^(?:otel_.*)$",k8s_namespace_name=~"^team-a$"}`: {"otel_x"},
+		`{__name__!~"^(?:otel_.*)$",namespace=~"^team-a$"}`:          {"up"},
+	}
+	r := newAPIRoutes(t, []string{"team-a"}, cfg, metrics)
+
+	var names []string
+	for _, name := range getData(t, r, "/api/v1/label/__name__/values").([]interface{}) {
+		names = append(names, name.(string))
+	}
+	sort.Strings(names)
+	if got := fmt.Sprint(names); got != "[node_load1 otel_x up]" {
+		t.Errorf("got metric names %s, want [node_load1 otel_x up]", got)
+	}
+
+	data := getData(t, r, "/api/v1/metadata").(map[string]interface{})
+	for _, name := range []string{"up", "node_load1"} {
+		if _, ok := data[name]; !ok {
+			t.Errorf("metadata of %s is missing", name)
+		}
+	}
+	if _, ok := data["x"]; ok {
+		t.Errorf("got metadata of x which is not in team-a")
+	}
+}
+
+func TestFilterExemplarsWithLabelMapping(t *testing.T) {
+	cfg := &Config{Enforcement: EnforcementConfig{
+		Labels: []LabelMapping{{Metric: "otel_.*", Label: "k8s_namespace_name"}},
+		Bypass: []BypassRule{{Metric: "node_.*"}},
+	}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":[
+			{"seriesLabels":{"__name__":"otel_x","k8s_namespace_name":"team-a","namespace":"team-b"},"exemplars":[{"value":"1"}]},
+			{"seriesLabels":{"__name__":"otel_x","k8s_namespace_name":"team-b","namespace":"team-a"},"exemplars":[{"value":"2"}]},
+			{"seriesLabels":{"__name__":"node_x"},"exemplars":[{"value":"3"}]},
+			{"seriesLabels":{"__name__":"x","namespace":"team-a"},"exemplars":[{"value":"4"}]}]}`)
+	}))
+	t.Cleanup(upstream.Close)
+	r := routesTo(t, upstream.URL, &cachedParser{namespaces: []string{"team-a"}}, cfg)
+	exemplars := getData(t, r, "/api/v1/query_exemplars?query=x")
+	value := func(item map[string]interface{}) string {
+		return item["exemplars"].([]interface{})[0].(map[string]interface{})["value"].(string)
+	}
+	if got := fieldValues(exemplars, value); !reflect.DeepEqual(got, []string{"1", "3", "4"}) {
+		t.Errorf("got exemplars %v, want [1 3 4]", got)
+	}
+}
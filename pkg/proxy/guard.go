@@ -0,0 +1,177 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+//checkQueryCost rejects queries exceeding the cost limits of the tenant
+//so that they do not overload thanos. expr is nil if request has no query
+func checkQueryCost(req *http.Request, expr promparser.Expr, cfg TenantConfig) error {
+	if strings.HasSuffix(req.URL.Path, "/query_range") {
+		if err := checkRange(req, cfg); err != nil {
+			return err
+		}
+	}
+	if expr == nil || cfg.MaxWindow <= 0 {
+		return nil
+	}
+	var err error
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		var window time.Duration
+		switch n := node.(type) {
+		case *promparser.MatrixSelector:
+			window = n.Range
+		case *promparser.SubqueryExpr:
+			window = n.Range
+		default:
+			return nil
+		}
+		if window > time.Duration(cfg.MaxWindow) {
+			err = fmt.Errorf("range %s in %q exceeds the maximum %s",
+				model.Duration(window), node.String(), model.Duration(cfg.MaxWindow))
+		}
+		return err
+	})
+	return err
+}
+
+//checkRange checks start, end and step of range query
+func checkRange(req *http.Request, cfg TenantConfig) error {
+	if cfg.MaxRange <= 0 && cfg.MinStep <= 0 && cfg.MaxPoints <= 0 {
+		return nil
+	}
+	start, err := parseTime(req.FormValue("start"))
+	if err != nil {
+		return fmt.Errorf("invalid parameter 'start': %v", err)
+	}
+	end, err := parseTime(req.FormValue("end"))
+	if err != nil {
+		return fmt.Errorf("invalid parameter 'end': %v", err)
+	}
+	step, err := parseDuration(req.FormValue("step"))
+	if err != nil {
+		return fmt.Errorf("invalid parameter 'step': %v", err)
+	}
+	if step <= 0 {
+		return fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	queryRange := end.Sub(start)
+	if cfg.MaxRange > 0 && queryRange > time.Duration(cfg.MaxRange) {
+		return fmt.Errorf("query range %s exceeds the maximum %s",
+			model.Duration(queryRange), model.Duration(cfg.MaxRange))
+	}
+	if cfg.MinStep > 0 && step < time.Duration(cfg.MinStep) {
+		return fmt.Errorf("query step %s is smaller than the minimum %s",
+			model.Duration(step), model.Duration(cfg.MinStep))
+	}
+	if points := int64(queryRange/step) + 1; cfg.MaxPoints > 0 && points > cfg.MaxPoints {
+		return fmt.Errorf("query would return %d points per series, exceeding the maximum %d. Increase step or reduce range",
+			points, cfg.MaxPoints)
+	}
+	return nil
+}
+
+//checkDenyList rejects queries using functions or selectors denied by policy
+func checkDenyList(expr promparser.Expr, cfg DenyListConfig) error {
+	var err error
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		switch n := node.(type) {
+		case *promparser.AggregateExpr:
+			if contains(cfg.Functions, n.Op.String()) {
+				err = fmt.Errorf("aggregation %s is not allowed", n.Op)
+			}
+		case *promparser.Call:
+			if contains(cfg.Functions, n.Func.Name) {
+				err = fmt.Errorf("function %s is not allowed", n.Func.Name)
+			}
+		case *promparser.VectorSelector:
+			err = checkSelector(n, cfg)
+		}
+		return err
+	})
+	return err
+}
+
+func checkSelector(vs *promparser.VectorSelector, cfg DenyListConfig) error {
+	hasName := vs.Name != ""
+	for _, m := range vs.LabelMatchers {
+		if m.Name != promlabels.MetricName {
+			continue
+		}
+		switch m.Type {
+		case promlabels.MatchEqual:
+			hasName = true
+		case promlabels.MatchRegexp, promlabels.MatchNotRegexp:
+			if cfg.NameRegexp {
+				return fmt.Errorf("regular expression on metric name is not allowed in %s", vs)
+			}
+		}
+	}
+	if cfg.SelectorsWithoutName && !hasName {
+		return fmt.Errorf("selector without metric name is not allowed: %s", vs)
+	}
+	return nil
+}
+
+//relabelDestination returns destination label of label_replace or label_join call, or of
+//count_values aggregation. ok tells whether node writes label, and dst is nil if its
+//destination is not a string literal
+func relabelDestination(node promparser.Node) (dst *promparser.StringLiteral, ok bool) {
+	switch n := node.(type) {
+	case *promparser.Call:
+		if n.Func.Name != "label_replace" && n.Func.Name != "label_join" {
+			return nil, false
+		}
+		if len(n.Args) < 2 {
+			return nil, true
+		}
+		return stringArg(n.Args[1]), true
+	case *promparser.AggregateExpr:
+		if n.Op != promparser.COUNT_VALUES {
+			return nil, false
+		}
+		return stringArg(n.Param), true
+	}
+	return nil, false
+}
+
+//stringArg returns string literal of argument unwrapped from parentheses and step invariant
+//nodes as the engine does, or nil if argument is not string literal
+func stringArg(arg promparser.Expr) *promparser.StringLiteral {
+	for {
+		switch n := arg.(type) {
+		case *promparser.StepInvariantExpr:
+			arg = n.Expr
+			continue
+		case *promparser.ParenExpr:
+			arg = n.Expr
+			continue
+		}
+		break
+	}
+	dst, _ := arg.(*promparser.StringLiteral)
+	return dst
+}
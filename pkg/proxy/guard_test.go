@@ -0,0 +1,141 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestCheckQueryCost(t *testing.T) {
+	limits := TenantConfig{
+		MaxRange:  Duration(24 * time.Hour),
+		MinStep:   Duration(15 * time.Second),
+		MaxPoints: 1000,
+		MaxWindow: Duration(time.Hour),
+	}
+	cases := []struct {
+		name   string
+		path   string
+		params url.Values
+		//err is part of the error if query is rejected
+		err string
+	}{
+		{"instant query", "/api/v1/query", url.Values{"query": {"rate(up[5m])"}}, ""},
+		{"range query", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"0"}, "end": {"3600"}, "step": {"15"}}, ""},
+		{"RFC3339 times", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"2020-01-01T00:00:00Z"}, "end": {"2020-01-01T01:00:00Z"}, "step": {"1m"}}, ""},
+		{"range too long", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"0"}, "end": {"90000"}, "step": {"120"}}, "query range 1d1h exceeds the maximum 1d"},
+		{"step too small", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"0"}, "end": {"60"}, "step": {"5"}}, "query step 5s is smaller than the minimum 15s"},
+		{"too many points", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"0"}, "end": {"36000"}, "step": {"15"}}, "query would return 2401 points per series"},
+		{"zero step", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"0"}, "end": {"60"}, "step": {"0"}}, "zero or negative"},
+		{"invalid start", "/api/v1/query_range",
+			url.Values{"query": {"up"}, "start": {"x"}, "end": {"60"}, "step": {"15"}}, "invalid parameter 'start'"},
+		{"window too long", "/api/v1/query", url.Values{"query": {"rate(up[2h])"}}, "range 2h in \"up[2h]\" exceeds the maximum 1h"},
+		{"subquery too long", "/api/v1/query", url.Values{"query": {"max_over_time(up[1d:5m])"}}, "exceeds the maximum 1h"},
+		{"nested window too long", "/api/v1/query", url.Values{"query": {"sum(rate(up[30m])) / sum(rate(up[3h]))"}}, "range 3h"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path+"?"+c.params.Encode(), nil)
+		expr, err := promparser.ParseExpr(c.params.Get("query"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkQueryCost(req, expr, limits)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got error %v, want %s", c.name, err, c.err)
+		}
+		//nothing is checked without limits
+		if err := checkQueryCost(req, expr, TenantConfig{}); err != nil {
+			t.Errorf("%s: rejected without limits: %v", c.name, err)
+		}
+	}
+}
+
+func TestCheckDenyList(t *testing.T) {
+	cfg := DenyListConfig{
+		Functions:            []string{"count_values", "absent_over_time"},
+		SelectorsWithoutName: true,
+		NameRegexp:           true,
+	}
+	cases := []struct {
+		query string
+		//err is the error if query is rejected
+		err string
+	}{
+		{`sum(rate(up{job="x"}[5m]))`, ""},
+		{`{__name__="up",job="x"}`, ""},
+		{`{__name__!="x",job="x"}`, `selector without metric name is not allowed: {__name__!="x",job="x"}`},
+		{`count_values("v", up)`, "aggregation count_values is not allowed"},
+		{`sum(absent_over_time(up[5m]))`, "function absent_over_time is not allowed"},
+		{`{job="x"}`, `selector without metric name is not allowed: {job="x"}`},
+		{`sum(rate({job="x"}[5m]))`, `selector without metric name is not allowed: {job="x"}`},
+		{`{__name__=~"up|x"}`, `regular expression on metric name is not allowed in {__name__=~"up|x"}`},
+		{`{__name__!~"x.*",job="x"}`, `regular expression on metric name is not allowed in {__name__!~"x.*",job="x"}`},
+	}
+	for _, c := range cases {
+		expr, err := promparser.ParseExpr(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkDenyList(expr, cfg)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.query, err)
+		case c.err != "" && (err == nil || err.Error() != c.err):
+			t.Errorf("%s: got error %v, want %s", c.query, err, c.err)
+		}
+		if err := checkDenyList(expr, DenyListConfig{}); err != nil {
+			t.Errorf("%s: rejected without deny list: %v", c.query, err)
+		}
+	}
+}
+
+func TestDenyListEndpoints(t *testing.T) {
+	p := &cachedParser{namespaces: []string{"team-a"}}
+	r := newTestRoutes(t, p, &Config{DenyList: DenyListConfig{NameRegexp: true}})
+	cases := map[string]url.Values{
+		"/api/v1/query":                 {"query": {`{__name__=~".+"}`}},
+		"/api/v1/series":                {"match[]": {`up`, `{__name__=~".+"}`}},
+		"/api/v1/labels":                {"match[]": {`{__name__=~".+"}`}},
+		"/api/v1/label/__name__/values": {"match[]": {`{__name__=~".+"}`}},
+		"/api/v1/query_exemplars":       {"query": {`{__name__=~".+"}`}},
+		"/api/v1/query_range":           {"query": {`{__name__=~".+"}`}, "start": {"0"}, "end": {"60"}, "step": {"15"}},
+	}
+	for path, params := range cases {
+		req := httptest.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
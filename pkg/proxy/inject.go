@@ -19,92 +19,590 @@ package proxy
 import (
 	"fmt"
 	"log"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
 
-	promlabels "github.com/prometheus/prometheus/pkg/labels"
+	promlabels "github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
 )
 
-func setRecursive(node promparser.Node, nsLabelname string, namespaces []string) (err error) {
+//enforcer holds what is injected into every selector of a query
+type enforcer struct {
+	nsLabelName string
+	namespaces  []string
+	//constraints restrict labels besides namespace label, e.g. cluster
+	constraints nsparser.Constraints
+	bypass      []bypassRule
+	labels      []labelRule
+	//relabel is the policy for label_replace, label_join and count_values writing enforced labels
+	relabel string
+	//denied is the policy for selectors of values which are not accessible
+	denied string
+	//branches restrict groups of cluster-qualified namespaces which can not be
+	//expressed by one selector. It is empty if selectors are restricted by this enforcer
+	branches []*enforcer
+	//report collects how selectors are restricted, if it is set. It is shared by branches
+	report *report
+}
+
+//labelRule maps metrics to the label carrying their namespace
+type labelRule struct {
+	metric *regexp.Regexp
+	label  string
+}
+
+//bypassRule matches selectors of metrics which have no namespace label,
+//e.g. node and cluster metrics
+type bypassRule struct {
+	//metric matches metric name of selector. nil matches any metric
+	metric *regexp.Regexp
+	//matchers must all be present in selector
+	matchers []*promlabels.Matcher
+	//label is enforced instead of namespace label. Empty means selector is not restricted
+	label string
+}
+
+//newBypassRules compiles bypass rules in proxy configuration
+func newBypassRules(cfg []BypassRule) ([]bypassRule, error) {
+	var rules []bypassRule
+	for _, c := range cfg {
+		if c.Metric == "" && c.Selector == "" {
+			return nil, fmt.Errorf("bypass rule must have metric or selector")
+		}
+		var rule bypassRule
+		if c.Metric != "" {
+			re, err := compileMetricPattern(c.Metric)
+			if err != nil {
+				return nil, fmt.Errorf("invalid metric pattern %q of bypass rule: %v", c.Metric, err)
+			}
+			rule.metric = re
+		}
+		if c.Selector != "" {
+			matchers, err := promparser.ParseMetricSelector(c.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %q of bypass rule: %v", c.Selector, err)
+			}
+			rule.matchers = matchers
+		}
+		rule.label = c.Label
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+//newLabelRules compiles label mapping in proxy configuration
+func newLabelRules(cfg []LabelMapping) ([]labelRule, error) {
+	var rules []labelRule
+	for _, c := range cfg {
+		if c.Metric == "" || c.Label == "" {
+			return nil, fmt.Errorf("label mapping must have metric and label")
+		}
+		re, err := compileMetricPattern(c.Metric)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric pattern %q of label mapping: %v", c.Metric, err)
+		}
+		rules = append(rules, labelRule{metric: re, label: c.Label})
+	}
+	return rules, nil
+}
+
+//compileMetricPattern compiles regular expression fully matching metric name
+func compileMetricPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+//matches tells whether rule applies to selector. Metric name must be selected by
+//equal matcher, and every matcher of rule must be present in selector, so that
+//the selector can not select series beyond the rule
+func (rule *bypassRule) matches(vs *promparser.VectorSelector) bool {
+	if rule.metric != nil && !rule.metric.MatchString(metricName(vs)) {
+		return false
+	}
+	for _, rm := range rule.matchers {
+		found := false
+		for _, m := range vs.LabelMatchers {
+			if m.Name == rm.Name && m.Type == rm.Type && m.Value == rm.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//matchesSeries tells whether rule applies to series of metric with labels
+func (rule *bypassRule) matchesSeries(metric string, value func(name string) string) bool {
+	if rule.metric != nil && !rule.metric.MatchString(metric) {
+		return false
+	}
+	for _, m := range rule.matchers {
+		if !m.Matches(value(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+//couldMatch tells whether selector may select series which rule applies to, although rule does not
+//match selector, e.g. kube_pod_info{job=~"kube-state-metrics"}. names are the metric names selector
+//can select, nil if they can not be listed
+func (rule *bypassRule) couldMatch(vs *promparser.VectorSelector, names []string) bool {
+	if rule.metric != nil && names != nil {
+		found := false
+		for _, name := range names {
+			if rule.metric.MatchString(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, rm := range rule.matchers {
+		for _, m := range vs.LabelMatchers {
+			if m.Name != rm.Name {
+				continue
+			}
+			values, ok := literalValues(m)
+			if !ok {
+				continue
+			}
+			found := false
+			for _, v := range values {
+				if rm.Matches(v) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//selectableNames returns metric names selector can select, e.g. by {__name__=~"a|b"}.
+//nil is returned if they can not be listed
+func selectableNames(vs *promparser.VectorSelector) []string {
+	for _, m := range vs.LabelMatchers {
+		if m.Name != promlabels.MetricName {
+			continue
+		}
+		if values, ok := literalValues(m); ok {
+			return values
+		}
+	}
+	return nil
+}
+
+//metricName returns metric name selected by equal matcher, or empty string
+func metricName(vs *promparser.VectorSelector) string {
+	for _, m := range vs.LabelMatchers {
+		if m.Name == promlabels.MetricName && m.Type == promlabels.MatchEqual {
+			return m.Value
+		}
+	}
+	return vs.Name
+}
+
+//labelFor returns the label carrying namespace of metric. The first matching
+//label mapping applies, otherwise the namespace label of upstream is used
+func (e *enforcer) labelFor(metric string) string {
+	for _, rule := range e.labels {
+		if rule.metric.MatchString(metric) {
+			return rule.label
+		}
+	}
+	return e.nsLabelName
+}
+
+//selectorLabels returns the label carrying namespace of series selected by vs, and the other labels
+//which may carry it if that can not be told, e.g. for {__name__=~"kube_.*"} or for selector which
+//a bypass rule with label could apply to. Bypass rules matching vs are not applied
+func (e *enforcer) selectorLabels(vs *promparser.VectorSelector) (string, []string) {
+	names := selectableNames(vs)
+	var candidates []string
+	for _, name := range names {
+		if label := e.labelFor(name); !contains(candidates, label) {
+			candidates = append(candidates, label)
+		}
+	}
+	label := e.nsLabelName
+	if len(candidates) == 1 {
+		label = candidates[0]
+	}
+	if names == nil {
+		for _, rule := range e.labels {
+			candidates = append(candidates, rule.label)
+		}
+	}
+	for _, rule := range e.bypass {
+		if rule.label != "" && rule.couldMatch(vs, names) {
+			candidates = append(candidates, rule.label)
+		}
+	}
+	var others []string
+	for _, c := range candidates {
+		if c != label && !contains(others, c) {
+			others = append(others, c)
+		}
+	}
+	return label, others
+}
+
+//seriesLabel returns the label carrying namespace of series with labels, applying bypass rules
+//and label mapping the same way as enforce does to selectors. Empty label is returned if
+//namespace of series is not restricted
+func (e *enforcer) seriesLabel(value func(name string) string) string {
+	metric := value(promlabels.MetricName)
+	for i := range e.bypass {
+		if e.bypass[i].matchesSeries(metric, value) {
+			return e.bypass[i].label
+		}
+	}
+	return e.labelFor(metric)
+}
+
+//scopeSelectors returns selectors of all series accessible through enforcer: series of bypassed
+//metrics, series of mapped metrics by their label, and series of the other metrics by namespace
+//label of upstream. They are used where no query selects series, e.g. to list label values
+func (e *enforcer) scopeSelectors() []*promparser.VectorSelector {
+	if len(e.branches) > 0 {
+		var selectors []*promparser.VectorSelector
+		for _, b := range e.branches {
+			selectors = append(selectors, b.scopeSelectors()...)
+		}
+		return selectors
+	}
+	restrict := func(matchers []*promlabels.Matcher, label string) *promparser.VectorSelector {
+		vs := &promparser.VectorSelector{LabelMatchers: matchers}
+		if label == "" && len(e.namespaces) == 0 {
+			label = e.nsLabelName
+		}
+		if label != "" && !isAllNamespaces(e.namespaces) {
+			vs.LabelMatchers = enforceLabelMatcher(vs.LabelMatchers, label, e.namespaces)
+		}
+		e.enforceConstraints(vs)
+		return vs
+	}
+	var selectors []*promparser.VectorSelector
+	for _, rule := range e.bypass {
+		matchers := append([]*promlabels.Matcher{}, rule.matchers...)
+		if rule.metric != nil {
+			matchers = append(matchers, promlabels.MustNewMatcher(promlabels.MatchRegexp, promlabels.MetricName, rule.metric.String()))
+		}
+		selectors = append(selectors, restrict(matchers, rule.label))
+	}
+	var mapped []string
+	for _, rule := range e.labels {
+		pattern := rule.metric.String()
+		mapped = append(mapped, pattern)
+		selectors = append(selectors, restrict([]*promlabels.Matcher{
+			promlabels.MustNewMatcher(promlabels.MatchRegexp, promlabels.MetricName, pattern),
+		}, rule.label))
+	}
+	var matchers []*promlabels.Matcher
+	if len(mapped) > 0 {
+		matchers = append(matchers, promlabels.MustNewMatcher(promlabels.MatchNotRegexp, promlabels.MetricName, strings.Join(mapped, "|")))
+	}
+	return append(selectors, restrict(matchers, e.nsLabelName))
+}
+
+//labelNames returns all labels which may carry namespace, namespace label of upstream first
+func (e *enforcer) labelNames() []string {
+	names := []string{e.nsLabelName}
+	for _, rule := range e.labels {
+		if !contains(names, rule.label) {
+			names = append(names, rule.label)
+		}
+	}
+	for _, rule := range e.bypass {
+		if rule.label != "" && !contains(names, rule.label) {
+			names = append(names, rule.label)
+		}
+	}
+	return names
+}
+
+//enforce injects namespaces into selector according to the first matching bypass rule,
+//or into the label mapped to its metric. Constrained labels are injected in any case. Denial is returned if selector selects values
+//which are not accessible and denied policy is error
+func (e *enforcer) enforce(vs *promparser.VectorSelector) error {
+	var original string
+	if e.report != nil {
+		original = vs.String()
+	}
+	label, others := e.selectorLabels(vs)
+	for i := range e.bypass {
+		if e.bypass[i].matches(vs) {
+			label, others = e.bypass[i].label, nil
+			break
+		}
+	}
+	//bypass rule without label only waives namespace label, constraints e.g. cluster still apply.
+	//Nothing is accessible without namespaces, bypassed metrics neither
+	if label == "" && len(e.namespaces) == 0 {
+		label = e.nsLabelName
+	}
+	var denials []*denial
+	if label != "" && !isAllNamespaces(e.namespaces) {
+		var d *denial
+		vs.LabelMatchers, d = restrictLabelMatcher(vs.LabelMatchers, label, e.namespaces, e.denied)
+		if d != nil {
+			denials = append(denials, d)
+		}
+		for _, other := range others {
+			denials = append(denials, e.enforceOptionalLabel(vs, other)...)
+		}
+	}
+	denials = append(denials, e.enforceConstraints(vs)...)
+	e.report.add(original, vs, label, denials)
+	if e.denied == deniedError && len(denials) > 0 {
+		return denials[0]
+	}
+	return nil
+}
+
+//enforceOptionalLabel injects namespaces into label which may carry namespace of series selected
+//by vs. Series without label are still selected, as they are restricted by the other label
+func (e *enforcer) enforceOptionalLabel(vs *promparser.VectorSelector, label string) []*denial {
+	for _, m := range vs.LabelMatchers {
+		if m.Name == label {
+			var d *denial
+			vs.LabelMatchers, d = restrictLabelMatcher(vs.LabelMatchers, label, e.namespaces, e.denied)
+			if d != nil {
+				return []*denial{d}
+			}
+			return nil
+		}
+	}
+	vs.LabelMatchers = append(vs.LabelMatchers, &promlabels.Matcher{
+		Type:  promlabels.MatchRegexp,
+		Name:  label,
+		Value: generateRegExpr(e.namespaces) + "|^$",
+	})
+	return nil
+}
+
+//enforceConstraints injects constrained labels besides namespace label into selector
+//with the same semantics as namespace label. It returns the values which are not accessible
+func (e *enforcer) enforceConstraints(vs *promparser.VectorSelector) []*denial {
+	names := make([]string, 0, len(e.constraints))
+	for name := range e.constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var denials []*denial
+	for _, name := range names {
+		var d *denial
+		vs.LabelMatchers, d = restrictLabelMatcher(vs.LabelMatchers, name, e.constraints[name], e.denied)
+		if d != nil {
+			denials = append(denials, d)
+		}
+	}
+	return denials
+}
+
+//inject restricts selectors of expr to the scope of enforcer, and returns the restricted expr
+func (e *enforcer) inject(expr promparser.Expr) (promparser.Expr, error) {
+	if err := e.checkRelabel(expr); err != nil {
+		return nil, err
+	}
+	if err := checkInfo(expr); err != nil {
+		return nil, err
+	}
+	if len(e.branches) > 0 {
+		return expand(expr, e.branches)
+	}
+	return expr, setRecursive(expr, e)
+}
+
+//checkInfo rejects info() without data label selector. The engine selects target_info by
+//identifying labels only, so the implicit selector can not be restricted
+func checkInfo(expr promparser.Expr) error {
+	var err error
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		if call, ok := node.(*promparser.Call); ok && call.Func.Name == "info" && len(call.Args) < 2 {
+			err = fmt.Errorf("info() must have data label selector, e.g. info(%s, {__name__=\"target_info\"})", call.Args[0])
+			return err
+		}
+		return nil
+	})
+	return err
+}
+
+//enforcedLabels returns all labels restricted by enforcer
+func (e *enforcer) enforcedLabels() []string {
+	names := e.labelNames()
+	for _, b := range append([]*enforcer{e}, e.branches...) {
+		for name := range b.constraints {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+//checkRelabel applies relabel policy to label_replace and label_join calls and count_values
+//aggregations writing enforced labels, which would make series look like series of other namespaces
+func (e *enforcer) checkRelabel(expr promparser.Expr) error {
+	if e.relabel == "" || e.relabel == relabelAllow {
+		return nil
+	}
+	enforced := e.enforcedLabels()
+	var err error
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		dst, ok := relabelDestination(node)
+		if !ok {
+			return nil
+		}
+		name := relabelName(node)
+		//destination which can not be checked may be an enforced label
+		if dst == nil {
+			err = fmt.Errorf("destination label of %s must be a string literal", name)
+			return err
+		}
+		if !contains(enforced, dst.Val) {
+			return nil
+		}
+		if e.relabel == relabelReject {
+			err = fmt.Errorf("%s is not allowed to write label %s", name, dst.Val)
+			return err
+		}
+		//exported_<label> may be enforced too, e.g. by label mapping
+		for contains(enforced, dst.Val) {
+			dst.Val = "exported_" + dst.Val
+		}
+		return nil
+	})
+	return err
+}
+
+//relabelName returns name of function or aggregation writing label
+func relabelName(node promparser.Node) string {
+	if call, ok := node.(*promparser.Call); ok {
+		return call.Func.Name
+	}
+	return node.(*promparser.AggregateExpr).Op.String()
+}
+
+func setRecursive(node promparser.Node, e *enforcer) (err error) {
 	switch n := node.(type) {
 	case *parser.EvalStmt:
-		if err := setRecursive(n.Expr, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Expr, e); err != nil {
 			return err
 		}
 
 	case parser.Expressions:
-		for _, e := range n {
-			if err := setRecursive(e, nsLabelname, namespaces); err != nil {
+		for _, expr := range n {
+			if err := setRecursive(expr, e); err != nil {
 				return err
 			}
 		}
 	case *parser.AggregateExpr:
-		if err := setRecursive(n.Expr, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Expr, e); err != nil {
 			return err
 		}
+		//parameter may select series too, e.g. topk(scalar(x), y)
+		if n.Param != nil {
+			if err := setRecursive(n.Param, e); err != nil {
+				return err
+			}
+		}
 
 	case *parser.BinaryExpr:
-		if err := setRecursive(n.LHS, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.LHS, e); err != nil {
 			return err
 		}
-		if err := setRecursive(n.RHS, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.RHS, e); err != nil {
 			return err
 		}
 
 	case *parser.Call:
-		if err := setRecursive(n.Args, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Args, e); err != nil {
 			return err
 		}
 
 	case *parser.ParenExpr:
-		if err := setRecursive(n.Expr, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Expr, e); err != nil {
 			return err
 		}
 
 	case *parser.UnaryExpr:
-		if err := setRecursive(n.Expr, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Expr, e); err != nil {
 			return err
 		}
 
 	case *parser.SubqueryExpr:
-		if err := setRecursive(n.Expr, nsLabelname, namespaces); err != nil {
+		if err := setRecursive(n.Expr, e); err != nil {
+			return err
+		}
+
+	case *parser.StepInvariantExpr:
+		if err := setRecursive(n.Expr, e); err != nil {
 			return err
 		}
 
-	case *parser.NumberLiteral, *parser.StringLiteral:
+	case *parser.NumberLiteral, *parser.StringLiteral, *parser.DurationExpr:
 		// nothing to do
 
 	case *parser.MatrixSelector:
 		// inject labelselector
-		if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
-			vs.LabelMatchers = enforceLabelMatcher(vs.LabelMatchers, nsLabelname, namespaces)
+		vs, ok := n.VectorSelector.(*parser.VectorSelector)
+		if !ok {
+			return fmt.Errorf("unexpected range vector selector %s", n)
 		}
+		return e.enforce(vs)
 
 	case *parser.VectorSelector:
-		// inject labelselector
-		n.LabelMatchers = enforceLabelMatcher(n.LabelMatchers, nsLabelname, namespaces)
+		// inject labelselector. @ modifier and offset are kept as they are
+		return e.enforce(n)
 
 	default:
-		panic(fmt.Errorf("promql.Walk: unhandled node type %T", node))
+		//unknown nodes may hold selectors, so the query is rejected rather than passed on unrestricted
+		return fmt.Errorf("unsupported PromQL node type %T", node)
 	}
 
 	return err
 }
 
+//noDataValue is the value of label matcher selecting no series
+const noDataValue = "__ibm-ocpthanos-proxy-no-data-namespace__"
+
 //This is where really injection is done.
 //It limits original query's namespace matcher
 //1. no namespace mather at all
 //2. use Equal matcher
 //3. use MatchRegexp but can only be simple pattern "name1|name2|name3". there should be no any kind of wildcard in names
-//otherwise it will return empty data by injecting noDataMatcher
+//otherwise it will return empty data by injecting noDataMatcher.
+//Constrained labels besides namespace label, e.g. cluster, are injected in the same way
 func enforceLabelMatcher(matchers []*promlabels.Matcher, nsLabelname string, namespaces []string) []*promlabels.Matcher {
+	res, _ := restrictLabelMatcher(matchers, nsLabelname, namespaces, deniedNoData)
+	return res
+}
+
+//restrictLabelMatcher works as enforceLabelMatcher, but values of label which are not accessible
+//are handled according to denied policy. The returned denial tells about them, it is nil if
+//selector only selects accessible values
+func restrictLabelMatcher(matchers []*promlabels.Matcher, nsLabelname string, namespaces []string, policy string) ([]*promlabels.Matcher, *denial) {
 	res := []*promlabels.Matcher{}
 	var nsMatcher *promlabels.Matcher
 	noDataMatcher := &promlabels.Matcher{
 		Type:  promlabels.MatchEqual,
 		Name:  nsLabelname,
-		Value: "__ibm-ocpthanos-proxy-no-data-namespace__",
+		Value: noDataValue,
 	}
 	for _, m := range matchers {
 		if m.Name == nsLabelname {
@@ -114,6 +612,13 @@ func enforceLabelMatcher(matchers []*promlabels.Matcher, nsLabelname string, nam
 		res = append(res, m)
 	}
 
+	if len(namespaces) == 0 {
+		//nothing is accessible, whatever the selector is
+		if nsMatcher == nil {
+			return append(res, noDataMatcher), nil
+		}
+		return append(res, noDataMatcher), &denial{label: nsLabelname, matcher: nsMatcher.String(), evaluated: true}
+	}
 	if nsMatcher == nil {
 		//create namespace matcher if raw expression does not containe one
 		nsMatcher = &promlabels.Matcher{
@@ -121,55 +626,197 @@ func enforceLabelMatcher(matchers []*promlabels.Matcher, nsLabelname string, nam
 			Name:  nsLabelname,
 			Value: generateRegExpr(namespaces),
 		}
-		return append(res, nsMatcher)
+		return append(res, nsMatcher), nil
 	}
+	d := &denial{label: nsLabelname, matcher: nsMatcher.String()}
 	//combine to existing namespace selector
 	if nsMatcher.Type == promlabels.MatchEqual {
-		allowed := false
-		for _, ns := range namespaces {
-			if ns == nsMatcher.Value {
-				allowed = true
-			}
-		}
-		if allowed {
-			return append(res, nsMatcher)
+		if contains(namespaces, nsMatcher.Value) {
+			return append(res, nsMatcher), nil
 		}
-
+		d.values = []string{nsMatcher.Value}
 	}
 	//namespace matcher value in query string is assumed in the format: 'name1|name2|name3'
-	//if any one (name1, name2, name3) is not accessible to user, noDataMatcher will be injected
+	//if any one (name1, name2, name3) is not accessible to user, noDataMatcher will be injected.
+	//Names are compared escaped, so that e.g. 'team.a' can not select 'team-a' beyond 'team.a'
 	if nsMatcher.Type == promlabels.MatchRegexp {
-		allowed := true
-		origNamespaces := strings.Split(nsMatcher.Value, "|")
-		for _, ons := range origNamespaces {
+		for _, ons := range strings.Split(nsMatcher.Value, "|") {
 			found := false
 			for _, ns := range namespaces {
-				if ons == ns {
+				if ons == regexp.QuoteMeta(ns) {
 					found = true
 					break
 				}
 			}
 			if !found {
-				allowed = false
-				break
+				d.values = append(d.values, ons)
 			}
 		}
-		if allowed {
-			return append(res, nsMatcher)
+		if len(d.values) == 0 {
+			return append(res, nsMatcher), nil
+		}
+	}
+	//narrow policy keeps the accessible namespaces selected by matcher of any format
+	if policy == deniedNarrow {
+		d = &denial{label: nsLabelname, matcher: nsMatcher.String()}
+		if m := narrowLabelMatcher(nsMatcher, namespaces, d); m != nil {
+			if !d.narrowed {
+				return append(res, m), nil
+			}
+			return append(res, m), d
 		}
+	}
+
+	log.Printf("no data matcher is injected query. %s matcher in query: %s. allowed values: %s",
+		nsLabelname, nsMatcher.Value, strings.Join(namespaces, ","))
+	return append(res, noDataMatcher), d
 
+}
+
+//narrowLabelMatcher returns matcher selecting the namespaces selected by m which are accessible,
+//and records the dropped ones in d. Matchers of literal values keep selecting them, other matchers
+//are evaluated against namespaces. It returns nil if no namespace is left
+func narrowLabelMatcher(m *promlabels.Matcher, namespaces []string, d *denial) *promlabels.Matcher {
+	if values, ok := literalValues(m); ok {
+		var kept []string
+		for _, v := range values {
+			if contains(namespaces, v) {
+				kept = append(kept, regexp.QuoteMeta(v))
+			} else {
+				d.values = append(d.values, v)
+			}
+		}
+		if len(d.values) == 0 {
+			return m
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		d.narrowed = true
+		return &promlabels.Matcher{Type: promlabels.MatchRegexp, Name: m.Name, Value: strings.Join(kept, "|")}
+	}
+	d.evaluated = true
+	matcher, err := promlabels.NewMatcher(m.Type, m.Name, m.Value)
+	if err != nil {
+		return nil
 	}
+	for _, ns := range namespaces {
+		if matcher.Matches(ns) {
+			d.kept = append(d.kept, ns)
+		}
+	}
+	if len(d.kept) == 0 {
+		return nil
+	}
+	d.narrowed = true
+	return &promlabels.Matcher{Type: promlabels.MatchRegexp, Name: m.Name, Value: generateRegExpr(d.kept)}
+}
 
-	log.Printf("no data matcher is injected query. namespace matcher in query: %s. allowed namespaces: %s",
-		nsMatcher.Value, strings.Join(namespaces, ","))
-	return append(res, noDataMatcher)
+//literalValues returns the values selected by matcher if they can be listed, i.e. matcher is = or
+//=~ with literal alternatives, e.g. 'a|b' or '(a|b)'
+func literalValues(m *promlabels.Matcher) ([]string, bool) {
+	switch {
+	case m.Type == promlabels.MatchEqual:
+		return []string{m.Value}, true
+	case m.Type != promlabels.MatchRegexp || strings.Contains(m.Value, `\Q`):
+		return nil, false
+	}
+	expr := m.Value
+	for strings.HasPrefix(expr, "(") && enclosed(expr) {
+		expr = strings.TrimPrefix(expr[1:len(expr)-1], "?:")
+	}
+	var values []string
+	start := 0
+	for i := 0; i <= len(expr); i++ {
+		if i < len(expr) && expr[i] == '\\' {
+			if i++; i == len(expr) {
+				return nil, false
+			}
+			continue
+		}
+		if i < len(expr) && expr[i] != '|' {
+			continue
+		}
+		re, err := syntax.Parse(expr[start:i], syntax.Perl)
+		if err != nil || re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		values = append(values, string(re.Rune))
+		start = i + 1
+	}
+	//values must be selected by matcher, whatever the alternatives are
+	for _, v := range values {
+		if !m.Matches(v) {
+			return nil, false
+		}
+	}
+	return values, true
+}
 
+//enclosed tells whether expr is one group, i.e. its first parenthesis is closed at its end
+func enclosed(expr string) bool {
+	depth := 0
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i == len(expr)-1
+			}
+		}
+	}
+	return false
 }
-func generateRegExpr(namespaces []string) string {
 
-	for i, ns := range namespaces {
-		namespaces[i] = "^" + ns + "$"
+//denial tells which values selected by matcher of label are not accessible to the caller
+type denial struct {
+	label   string
+	matcher string
+	//values which are not accessible. It is empty if values of matcher can not be listed
+	values []string
+	//evaluated tells whether matcher is evaluated against accessible values, and kept are the ones it selects
+	evaluated bool
+	kept      []string
+	//narrowed tells whether the accessible values are still selected
+	narrowed bool
+}
+
+func (d *denial) Error() string {
+	switch {
+	case len(d.values) > 0:
+		return fmt.Sprintf("access denied to %s %s", d.label, quoteJoin(d.values))
+	case d.narrowed:
+		return fmt.Sprintf("%s matcher %s is narrowed to accessible values %s", d.label, d.matcher, quoteJoin(d.kept))
+	case d.evaluated:
+		return fmt.Sprintf("%s matcher %s selects no accessible value", d.label, d.matcher)
+	}
+	return fmt.Sprintf("%s matcher %s is not supported, use = or =~ with values separated by |", d.label, d.matcher)
+}
+
+//quoteJoin returns quoted values separated by comma
+func quoteJoin(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
 	}
-	return strings.Join(namespaces, "|")
+	return strings.Join(quoted, ", ")
+}
 
+//generateRegExpr returns regular expression matching namespaces only. Namespaces are escaped,
+//as values returned by namespace parser may contain metacharacters, e.g. '.'.
+//namespaces may be shared with namespace parser and other requests, so it is not changed.
+//Empty namespaces match noDataValue only, as empty regular expression would match every series
+func generateRegExpr(namespaces []string) string {
+	if len(namespaces) == 0 {
+		return "^" + regexp.QuoteMeta(noDataValue) + "$"
+	}
+	anchored := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		anchored[i] = "^" + regexp.QuoteMeta(ns) + "$"
+	}
+	return strings.Join(anchored, "|")
 }
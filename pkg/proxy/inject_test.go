@@ -0,0 +1,687 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//matchesOnlyAllowed tells whether matchers of label can only select allowed values or noDataValue
+func matchesOnlyAllowed(t *testing.T, matchers []*promlabels.Matcher, label string, allowed []string, value string) bool {
+	for _, m := range matchers {
+		if m.Name != label {
+			continue
+		}
+		compiled, err := promlabels.NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			t.Fatalf("injected matcher %s is invalid: %v", m, err)
+		}
+		if !compiled.Matches(value) {
+			return true
+		}
+	}
+	return value == noDataValue || contains(allowed, value)
+}
+
+func FuzzEnforceLabelMatcher(f *testing.F) {
+	f.Add("team-a", "team-b", uint8(promlabels.MatchRegexp), "", "team-a")
+	f.Add("team.a", "team-b", uint8(promlabels.MatchRegexp), "", "team-a")
+	f.Add("team.a", "team-b", uint8(promlabels.MatchRegexp), "team.a", "teamxa")
+	f.Add("a|b", "c", uint8(promlabels.MatchRegexp), "a|b", "b")
+	f.Add(".*", "c", uint8(promlabels.MatchRegexp), ".*", "anything")
+	f.Add("a+", "(b)", uint8(promlabels.MatchEqual), "a+", "aa")
+	f.Add("team-a", "team-b", uint8(promlabels.MatchNotRegexp), "team-a", "team-c")
+	f.Add("team-a", "team-b", uint8(promlabels.MatchNotEqual), "team-a", "team-c")
+	f.Add("team-a", "team-b", uint8(promlabels.MatchRegexp), "(team-a|team-c)", "team-a")
+	f.Fuzz(func(t *testing.T, ns1, ns2 string, matchType uint8, query, value string) {
+		//label values are valid UTF-8
+		if !utf8.ValidString(ns1) || !utf8.ValidString(ns2) || !utf8.ValidString(value) {
+			t.Skip()
+		}
+		allowed := []string{ns1, ns2}
+		var matchers []*promlabels.Matcher
+		if query != "" {
+			m, err := promlabels.NewMatcher(promlabels.MatchType(matchType%4), "namespace", query)
+			if err != nil {
+				t.Skip()
+			}
+			matchers = append(matchers, m)
+		}
+		injected := enforceLabelMatcher(matchers, "namespace", allowed)
+		if !matchesOnlyAllowed(t, injected, "namespace", allowed, value) {
+			t.Errorf("%v injected for %v selects %q", injected, allowed, value)
+		}
+		//narrowed matcher selects values which are both allowed and selected by query
+		narrowed, _ := restrictLabelMatcher(matchers, "namespace", allowed, deniedNarrow)
+		if !matchesOnlyAllowed(t, narrowed, "namespace", allowed, value) ||
+			len(matchers) > 0 && !matchesOnlyAllowed(t, narrowed, "namespace", nil, value) && !matchers[0].Matches(value) {
+			t.Errorf("%v narrowed for %v selects %q", narrowed, allowed, value)
+		}
+	})
+}
+
+var testNamespaces = []string{"team-a", "team-b"}
+
+const testNSMatcher = `namespace=~"^team-a$|^team-b$"`
+
+func TestSetRecursive(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"vector selector", `up`, `up{` + testNSMatcher + `}`},
+		{"selector without name", `{job="x"}`, `{job="x",` + testNSMatcher + `}`},
+		{"allowed equal matcher", `up{namespace="team-a"}`, `up{namespace="team-a"}`},
+		{"denied equal matcher", `up{namespace="team-c"}`, `up{namespace="` + noDataValue + `"}`},
+		{"allowed regexp matcher", `up{namespace=~"team-a|team-b"}`, `up{namespace=~"team-a|team-b"}`},
+		{"denied regexp matcher", `up{namespace=~"team-.*"}`, `up{namespace="` + noDataValue + `"}`},
+		{"not equal matcher", `up{namespace!="team-a"}`, `up{namespace="` + noDataValue + `"}`},
+		{"not regexp matcher", `up{namespace!~"team-a"}`, `up{namespace="` + noDataValue + `"}`},
+		{"matrix selector", `up[5m]`, `up{` + testNSMatcher + `}[5m]`},
+		{"offset", `up offset 1h`, `up{` + testNSMatcher + `} offset 1h`},
+		{"number literal", `1`, `1`},
+		{"string literal", `"a"`, `"a"`},
+		{"paren", `(up)`, `(up{` + testNSMatcher + `})`},
+		{"unary", `-up`, `-up{` + testNSMatcher + `}`},
+		{"binary", `up / on(job) group_left() x`, `up{` + testNSMatcher + `} / on (job) group_left () x{` + testNSMatcher + `}`},
+		{"call", `rate(x[5m])`, `rate(x{` + testNSMatcher + `}[5m])`},
+		{"call with several args", `label_replace(up, "a", "$1", "job", "(.*)")`, `label_replace(up{` + testNSMatcher + `}, "a", "$1", "job", "(.*)")`},
+		{"aggregate", `sum by(job) (up)`, `sum by (job) (up{` + testNSMatcher + `})`},
+		{"aggregate param", `topk(scalar(x), up)`, `topk(scalar(x{` + testNSMatcher + `}), up{` + testNSMatcher + `})`},
+		{"aggregate param subquery", `quantile(scalar(max_over_time(x[1h:5m])), up)`,
+			`quantile(scalar(max_over_time(x{` + testNSMatcher + `}[1h:5m])), up{` + testNSMatcher + `})`},
+		{"nested aggregate param", `bottomk(scalar(topk(scalar(x), y)), up)`,
+			`bottomk(scalar(topk(scalar(x{` + testNSMatcher + `}), y{` + testNSMatcher + `})), up{` + testNSMatcher + `})`},
+		{"subquery", `max_over_time(up[1h:5m])`, `max_over_time(up{` + testNSMatcher + `}[1h:5m])`},
+		{"nested subquery", `max_over_time(rate(x[5m])[1h:])`, `max_over_time(rate(x{` + testNSMatcher + `}[5m])[1h:])`},
+		{"@ timestamp", `up @ 1609746000`, `up{` + testNSMatcher + `} @ 1609746000.000`},
+		{"@ start", `up @ start()`, `up{` + testNSMatcher + `} @ start()`},
+		{"@ and offset in range", `rate(x[5m] @ end() offset 1m)`, `rate(x{` + testNSMatcher + `}[5m] @ end() offset 1m)`},
+		{"@ and offset in subquery", `max_over_time(rate(x[5m])[1h:5m] @ 1609746000 offset 5m)`,
+			`max_over_time(rate(x{` + testNSMatcher + `}[5m])[1h:5m] @ 1609746000.000 offset 5m)`},
+		{"histogram_quantile", `histogram_quantile(0.9, sum by (le) (rate(x[5m])))`,
+			`histogram_quantile(0.9, sum by (le) (rate(x{` + testNSMatcher + `}[5m])))`},
+		{"native histogram functions", `histogram_count(rate(x[5m])) / histogram_sum(rate(x[5m]))`,
+			`histogram_count(rate(x{` + testNSMatcher + `}[5m])) / histogram_sum(rate(x{` + testNSMatcher + `}[5m]))`},
+		{"histogram_fraction", `histogram_fraction(0, 0.2, rate(x[5m]))`, `histogram_fraction(0, 0.2, rate(x{` + testNSMatcher + `}[5m]))`},
+		{"info with data label selector", `info(up, {k8s_cluster_name=~".+"})`,
+			`info(up{` + testNSMatcher + `}, {k8s_cluster_name=~".+",` + testNSMatcher + `})`},
+		{"experimental aggregate", `limitk(2, up)`, `limitk(2, up{` + testNSMatcher + `})`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, err := promparser.ParseExpr(c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := setRecursive(expr, &enforcer{nsLabelName: "namespace", namespaces: testNamespaces}); err != nil {
+				t.Fatal(err)
+			}
+			if got := expr.String(); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetRecursiveStatements(t *testing.T) {
+	e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces}
+	vs := &promparser.VectorSelector{Name: "up", LabelMatchers: []*promlabels.Matcher{
+		promlabels.MustNewMatcher(promlabels.MatchEqual, promlabels.MetricName, "up"),
+	}}
+	if err := setRecursive(&promparser.EvalStmt{Expr: vs}, e); err != nil {
+		t.Fatal(err)
+	}
+	x := &promparser.VectorSelector{Name: "x"}
+	if err := setRecursive(promparser.Expressions{x}, e); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*promparser.VectorSelector{vs, x} {
+		checkInjected(t, s, "namespace", testNamespaces, "")
+	}
+}
+
+//unknownExpr is a node type unknown to the injector
+type unknownExpr struct {
+	promparser.Expr
+}
+
+func TestSetRecursiveNodeTypes(t *testing.T) {
+	e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces}
+	vs := &promparser.VectorSelector{Name: "up"}
+	//the engine wraps step invariant parts of queries, e.g. selectors with @ modifier
+	if err := setRecursive(&promparser.StepInvariantExpr{Expr: vs}, e); err != nil {
+		t.Fatal(err)
+	}
+	checkInjected(t, vs, "namespace", testNamespaces, "")
+	if err := setRecursive(&unknownExpr{&promparser.VectorSelector{Name: "up"}}, e); err == nil {
+		t.Error("unknown node type is not rejected")
+	}
+}
+
+//checkInjected checks that selector has exactly one matcher of label, which
+//selects no value other than allowed ones, e.g. value
+func checkInjected(t *testing.T, vs *promparser.VectorSelector, label string, allowed []string, value string) {
+	var found []*promlabels.Matcher
+	for _, m := range vs.LabelMatchers {
+		if m.Name == label {
+			found = append(found, m)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("%s has %d %s matchers, want 1", vs, len(found), label)
+	}
+	for _, v := range append([]string{value, ""}, allowed...) {
+		if !matchesOnlyAllowed(t, found, label, allowed, v) {
+			t.Errorf("%s selects %q beyond %v", vs, v, allowed)
+		}
+	}
+}
+
+//checkQuery injects namespaces into query and checks every selector of the result
+func checkQuery(t *testing.T, query string, value string) {
+	expr, err := promparser.ParseExpr(query)
+	if err != nil {
+		t.Skip()
+	}
+	if err := setRecursive(expr, &enforcer{nsLabelName: "namespace", namespaces: testNamespaces}); err != nil {
+		return
+	}
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		if vs, ok := node.(*promparser.VectorSelector); ok {
+			checkInjected(t, vs, "namespace", testNamespaces, value)
+		}
+		return nil
+	})
+	if _, err := promparser.ParseExpr(expr.String()); err != nil {
+		//string literals are not always printed as valid PromQL by the parser itself
+		orig, _ := promparser.ParseExpr(query)
+		if _, origErr := promparser.ParseExpr(orig.String()); origErr == nil {
+			t.Errorf("injected query %s of %s is invalid: %v", expr, query, err)
+		}
+	}
+}
+
+func FuzzSetRecursive(f *testing.F) {
+	for _, query := range []string{
+		`up`,
+		`up{namespace="team-a"}`,
+		`up{namespace=~"team-a|team-c"}`,
+		`up{namespace!~"team-a"}`,
+		`up{namespace="team-a",namespace=~".*"}`,
+		`sum by(namespace) (rate(http_requests_total{job="x"}[5m] offset 1h))`,
+		`topk(scalar(x), up) / on(job) group_left() -count_values("v", y)`,
+		`max_over_time((rate(x[5m]) > bool 1)[1h:5m])`,
+		`label_replace(vector(1), "namespace", "team-c", "", "")`,
+		`{__name__=~"x.*"} or absent(y)`,
+		`max_over_time(rate(x[5m] @ end())[1h:5m] @ start() offset 1m)`,
+		`histogram_quantile(0.9, sum by (le) (rate(x[5m])))`,
+		`histogram_fraction(0, 0.2, rate(x[5m])) / histogram_count(rate(x[5m]))`,
+		`info(up, {k8s_cluster_name=~".+"})`,
+	} {
+		f.Add(query, "team-c")
+	}
+	f.Fuzz(func(t *testing.T, query string, value string) {
+		if !utf8.ValidString(value) {
+			t.Skip()
+		}
+		checkQuery(t, query, value)
+	})
+}
+
+//generateExpr builds PromQL expression from random data, so that fuzzing
+//covers combinations of node types which are hard to reach by mutating strings
+func generateExpr(data []byte, depth int) (string, []byte) {
+	next := func() byte {
+		if len(data) == 0 {
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return b
+	}
+	selector := func() string {
+		matchers := []string{
+			``,
+			`{namespace="team-a"}`,
+			`{namespace="team-c"}`,
+			`{namespace=~"team-a|team-b"}`,
+			`{namespace=~".+"}`,
+			`{namespace!="team-a"}`,
+			`{job="x",namespace=~"team-b"}`,
+		}
+		return "metric" + matchers[int(next())%len(matchers)]
+	}
+	if depth <= 0 {
+		return selector(), data
+	}
+	var sub, sub2 string
+	switch next() % 10 {
+	case 0:
+		return selector(), data
+	case 1:
+		return "rate(" + selector() + "[5m])", data
+	case 2:
+		sub, data = generateExpr(data, depth-1)
+		return "sum by(namespace) (" + sub + ")", data
+	case 3:
+		sub, data = generateExpr(data, depth-1)
+		sub2, data = generateExpr(data, depth-1)
+		return "topk(scalar(" + sub + "), " + sub2 + ")", data
+	case 4:
+		sub, data = generateExpr(data, depth-1)
+		sub2, data = generateExpr(data, depth-1)
+		ops := []string{" + ", " / on() group_left() ", " or ", " unless ", " > bool "}
+		return sub + ops[int(next())%len(ops)] + sub2, data
+	case 5:
+		sub, data = generateExpr(data, depth-1)
+		return "(" + sub + ")", data
+	case 6:
+		sub, data = generateExpr(data, depth-1)
+		return "-" + sub, data
+	case 7:
+		sub, data = generateExpr(data, depth-1)
+		return "max_over_time((" + sub + ")[1h:5m])", data
+	case 8:
+		sub, data = generateExpr(data, depth-1)
+		return `label_replace(` + sub + `, "a", "$1", "namespace", "(.*)")`, data
+	default:
+		return selector() + " offset 5m", data
+	}
+}
+
+func FuzzGeneratedExpr(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "team-c")
+	f.Add([]byte{4, 2, 3, 7, 1, 5, 6, 9, 8}, "")
+	f.Fuzz(func(t *testing.T, data []byte, value string) {
+		if !utf8.ValidString(value) {
+			t.Skip()
+		}
+		query, _ := generateExpr(data, 4)
+		checkQuery(t, query, value)
+	})
+}
+
+func TestRelabelPolicy(t *testing.T) {
+	cases := []struct {
+		policy string
+		query  string
+		//want is empty if query is rejected
+		want string
+	}{
+		{relabelAllow, `label_replace(up, "namespace", "other", "", "")`,
+			`label_replace(up{` + testNSMatcher + `,tenant=~"^t1$"}, "namespace", "other", "", "")`},
+		{relabelReject, `label_replace(up, "namespace", "other", "", "")`, ""},
+		{relabelReject, `label_join(up, "tenant", ",", "job")`, ""},
+		{relabelReject, `label_replace(up, "job", "other", "", "")`,
+			`label_replace(up{` + testNSMatcher + `,tenant=~"^t1$"}, "job", "other", "", "")`},
+		{relabelRewrite, `sum(label_join(up, "namespace", ",", "job"))`,
+			`sum(label_join(up{` + testNSMatcher + `,tenant=~"^t1$"}, "exported_namespace", ",", "job"))`},
+		{relabelRewrite, `label_replace(x, "k8s_namespace_name", "other", "", "")`,
+			`label_replace(x{k8s_namespace_name=~"^team-a$|^team-b$",tenant=~"^t1$"}, "exported_k8s_namespace_name", "other", "", "")`},
+		//the engine unwraps parentheses of destination
+		{relabelReject, `label_replace(up, ("namespace"), "other", "", "")`, ""},
+		{relabelReject, `label_join(up, (("tenant")), ",", "job")`, ""},
+		{relabelRewrite, `label_replace(up, ("namespace"), "other", "", "")`,
+			`label_replace(up{` + testNSMatcher + `,tenant=~"^t1$"}, ("exported_namespace"), "other", "", "")`},
+		{relabelRewrite, `label_join(up, (("tenant")), ",", "job")`,
+			`label_join(up{` + testNSMatcher + `,tenant=~"^t1$"}, (("exported_tenant")), ",", "job")`},
+		//count_values writes sample values into its label
+		{relabelReject, `count_values("namespace", up{namespace="team-a"})`, ""},
+		{relabelReject, `sum(count_values(("tenant"), up))`, ""},
+		{relabelReject, `count_values("job", up)`, `count_values("job", up{` + testNSMatcher + `,tenant=~"^t1$"})`},
+		{relabelRewrite, `count_values("namespace", up{namespace="team-a"})`,
+			`count_values("exported_namespace", up{namespace="team-a",tenant=~"^t1$"})`},
+		{relabelAllow, `count_values("namespace", up)`, `count_values("namespace", up{` + testNSMatcher + `,tenant=~"^t1$"})`},
+	}
+	labels, err := newLabelRules([]LabelMapping{{Metric: "x", Label: "k8s_namespace_name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		e := &enforcer{
+			nsLabelName: "namespace",
+			namespaces:  testNamespaces,
+			constraints: map[string][]string{"tenant": {"t1"}},
+			labels:      labels,
+			relabel:     c.policy,
+		}
+		expr, err := promparser.ParseExpr(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expr, err = e.inject(expr)
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("%s: %s is not rejected", c.policy, c.query)
+		case c.want != "" && err != nil:
+			t.Errorf("%s: %s: %v", c.policy, c.query, err)
+		case c.want != "" && expr.String() != c.want:
+			t.Errorf("%s: got %s, want %s", c.policy, expr, c.want)
+		}
+	}
+}
+
+func TestRelabelDestination(t *testing.T) {
+	call := func(dst promparser.Expr) *promparser.Call {
+		expr, err := promparser.ParseExpr(`label_replace(up, "job", "other", "", "")`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*promparser.Call)
+		c.Args[1] = dst
+		return c
+	}
+	literal := &promparser.StringLiteral{Val: "namespace"}
+	cases := []struct {
+		name string
+		dst  promparser.Expr
+		//want is nil if destination is not a string literal
+		want *promparser.StringLiteral
+	}{
+		{"literal", literal, literal},
+		{"paren", &promparser.ParenExpr{Expr: literal}, literal},
+		{"step invariant", &promparser.StepInvariantExpr{Expr: &promparser.ParenExpr{Expr: literal}}, literal},
+		{"not literal", &promparser.NumberLiteral{Val: 1}, nil},
+	}
+	for _, c := range cases {
+		dst, ok := relabelDestination(call(c.dst))
+		if !ok || dst != c.want {
+			t.Errorf("%s: got %v, %v, want %v", c.name, dst, ok, c.want)
+		}
+	}
+	if _, ok := relabelDestination(&promparser.Call{Func: promparser.Functions["rate"]}); ok {
+		t.Errorf("rate is taken as relabeling function")
+	}
+
+	//non-literal destination may be an enforced label, so it is rejected by every policy but allow
+	for _, policy := range []string{relabelReject, relabelRewrite} {
+		e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces, relabel: policy}
+		if _, err := e.inject(call(&promparser.NumberLiteral{Val: 1})); err == nil {
+			t.Errorf("%s: non-literal destination is not rejected", policy)
+		}
+	}
+}
+
+func TestLiteralValues(t *testing.T) {
+	cases := []struct {
+		value string
+		want  []string
+	}{
+		{`a|b`, []string{"a", "b"}},
+		{`(a|b)`, []string{"a", "b"}},
+		{`((?:a|b))`, []string{"a", "b"}},
+		{`team\.a|team-b`, []string{"team.a", "team-b"}},
+		{`a\|b`, []string{"a|b"}},
+		{`(a)|(b)`, nil},
+		{`a.*`, nil},
+		{`a|`, nil},
+		{`(?i)a`, nil},
+		{`\Qa|b\E`, nil},
+		{`[|]`, nil},
+	}
+	for _, c := range cases {
+		m, err := promlabels.NewMatcher(promlabels.MatchRegexp, "namespace", c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := literalValues(m)
+		if ok != (c.want != nil) || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %q, %v, want %q", c.value, got, ok, c.want)
+		}
+	}
+}
+
+func TestDeniedPolicy(t *testing.T) {
+	noData := `namespace="` + noDataValue + `"`
+	cases := []struct {
+		policy string
+		query  string
+		want   string
+		//err is the error if query is rejected
+		err string
+	}{
+		{deniedNoData, `up{namespace="team-c"}`, `up{` + noData + `}`, ""},
+		{deniedNoData, `up{namespace=~"team-a|team-c"}`, `up{` + noData + `}`, ""},
+		{deniedError, `up{namespace="team-a"}`, `up{namespace="team-a"}`, ""},
+		{deniedError, `up{namespace="team-c"}`, "", `access denied to namespace "team-c"`},
+		{deniedError, `sum(rate(up{namespace=~"team-a|team-c|team-d"}[5m]))`, "", `access denied to namespace "team-c", "team-d"`},
+		{deniedError, `up{namespace!="team-a"}`, "", `namespace matcher namespace!="team-a" is not supported, use = or =~ with values separated by |`},
+		{deniedNarrow, `up{namespace=~"team-a|team-c"}`, `up{namespace=~"team-a"}`, ""},
+		{deniedNarrow, `up{namespace=~"team-a|team-b|team-.*"}`, `up{` + testNSMatcher + `}`, ""},
+		{deniedNarrow, `up{namespace=~"(team-a|team-b)"}`, `up{namespace=~"(team-a|team-b)"}`, ""},
+		{deniedNarrow, `up{namespace=~"(?:team-b|team-c)"}`, `up{namespace=~"team-b"}`, ""},
+		{deniedNarrow, `up{namespace=~".*"}`, `up{` + testNSMatcher + `}`, ""},
+		{deniedNarrow, `up{namespace=~"team-[b-z]"}`, `up{namespace=~"^team-b$"}`, ""},
+		{deniedNarrow, `up{namespace!="team-a"}`, `up{namespace=~"^team-b$"}`, ""},
+		{deniedNarrow, `up{namespace!~"team-.*"}`, `up{` + noData + `}`, ""},
+		{deniedNarrow, `up{namespace=~"(?i)TEAM-A|team-c"}`, `up{namespace=~"^team-a$"}`, ""},
+		{deniedNarrow, `up{namespace=~"team-c|team-d"}`, `up{` + noData + `}`, ""},
+		{deniedNarrow, `up{namespace="team-c"}`, `up{` + noData + `}`, ""},
+	}
+	for _, c := range cases {
+		e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces, denied: c.policy}
+		expr, err := promparser.ParseExpr(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expr, err = e.inject(expr)
+		switch {
+		case c.err != "":
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: %s: got error %v, want %s", c.policy, c.query, err, c.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %s: %v", c.policy, c.query, err)
+		case expr.String() != c.want:
+			t.Errorf("%s: got %s, want %s", c.policy, expr, c.want)
+		}
+	}
+}
+
+func TestBypassAndLabelMapping(t *testing.T) {
+	bypass, err := newBypassRules([]BypassRule{
+		{Metric: "node_.*"},
+		{Selector: `{job="kube-state-metrics"}`, Label: "exported_namespace"},
+		{Metric: "kube_.*", Selector: `{job="other"}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := newLabelRules([]LabelMapping{{Metric: "otel_.*", Label: "k8s_namespace_name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces, bypass: bypass, labels: labels}
+	//anyNS matches accessible namespaces and absent label
+	anyNS := `"^team-a$|^team-b$|^$"`
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`node_load1`, `node_load1`},
+		{`{__name__="node_load1"}`, `{__name__="node_load1"}`},
+		//metric name must be selected by equal matcher to bypass namespace label, and series of
+		//other labels which may carry namespace must have accessible values in them if they have any
+		{`{__name__=~"node_.*"}`, `{__name__=~"node_.*",exported_namespace=~` + anyNS + `,k8s_namespace_name=~` + anyNS + `,` + testNSMatcher + `}`},
+		{`{__name__=~"otel_requests_total"}`, `{__name__=~"otel_requests_total",exported_namespace=~` + anyNS + `,k8s_namespace_name=~"^team-a$|^team-b$"}`},
+		{`{__name__=~"otel_x|up"}`, `{__name__=~"otel_x|up",exported_namespace=~` + anyNS + `,k8s_namespace_name=~` + anyNS + `,` + testNSMatcher + `}`},
+		{`kube_pod_info{job="kube-state-metrics"}`, `kube_pod_info{exported_namespace=~"^team-a$|^team-b$",job="kube-state-metrics"}`},
+		//bypass rule with label could apply to series of selectors which do not match it exactly
+		{`kube_pod_info{job=~"kube-state-metrics"}`, `kube_pod_info{exported_namespace=~` + anyNS + `,job=~"kube-state-metrics",` + testNSMatcher + `}`},
+		{`kube_pod_info{job=~"kube-state-metrics",exported_namespace="team-c"}`,
+			`kube_pod_info{exported_namespace="` + noDataValue + `",job=~"kube-state-metrics",` + testNSMatcher + `}`},
+		{`kube_pod_info`, `kube_pod_info{exported_namespace=~` + anyNS + `,` + testNSMatcher + `}`},
+		{`kube_pod_info{job="node"}`, `kube_pod_info{job="node",` + testNSMatcher + `}`},
+		{`kube_pod_info{job="other"}`, `kube_pod_info{job="other"}`},
+		{`otel_requests_total{job="node"}`, `otel_requests_total{job="node",k8s_namespace_name=~"^team-a$|^team-b$"}`},
+		//bypass rules take precedence over label mapping
+		{`otel_x{job="kube-state-metrics"}`, `otel_x{exported_namespace=~"^team-a$|^team-b$",job="kube-state-metrics"}`},
+		{`rate(otel_x{job="x"}[5m]) / node_load1`, `rate(otel_x{job="x",k8s_namespace_name=~"^team-a$|^team-b$"}[5m]) / node_load1`},
+	}
+	for _, c := range cases {
+		expr, err := promparser.ParseExpr(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr, err = e.inject(expr); err != nil {
+			t.Errorf("%s: %v", c.query, err)
+			continue
+		}
+		if got := expr.String(); got != c.want {
+			t.Errorf("got %s, want %s", got, c.want)
+		}
+	}
+
+	series := []struct {
+		labels map[string]interface{}
+		//label is empty if namespace of series is not restricted
+		label string
+	}{
+		{map[string]interface{}{"__name__": "node_load1"}, ""},
+		{map[string]interface{}{"__name__": "kube_pod_info", "job": "kube-state-metrics"}, "exported_namespace"},
+		{map[string]interface{}{"__name__": "kube_pod_info", "job": "other"}, ""},
+		{map[string]interface{}{"__name__": "kube_pod_info", "job": "x"}, "namespace"},
+		{map[string]interface{}{"__name__": "otel_x"}, "k8s_namespace_name"},
+	}
+	for _, s := range series {
+		if label := e.seriesLabel(labelsOf(s.labels)); label != s.label {
+			t.Errorf("%v: got label %q, want %q", s.labels, label, s.label)
+		}
+	}
+
+	var selectors []string
+	for _, vs := range e.scopeSelectors() {
+		selectors = append(selectors, vs.String())
+	}
+	want := []string{
+		`{__name__=~"^(?:node_.*)$"}`,
+		`{exported_namespace=~"^team-a$|^team-b$",job="kube-state-metrics"}`,
+		`{__name__=~"^(?:kube_.*)$",job="other"}`,
+		`{__name__=~"^(?:otel_.*)$",k8s_namespace_name=~"^team-a$|^team-b$"}`,
+		`{__name__!~"^(?:otel_.*)$",` + testNSMatcher + `}`,
+	}
+	if !reflect.DeepEqual(selectors, want) {
+		t.Errorf("got scope selectors %q, want %q", selectors, want)
+	}
+}
+
+func TestBypassConstraints(t *testing.T) {
+	bypass, err := newBypassRules([]BypassRule{{Metric: "node_.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRoutes(t, &cachedParser{}, &Config{})
+	r.bypass = bypass
+	up := r.upstreams[defaultUpstreamName]
+	cases := []struct {
+		name       string
+		namespaces []string
+		labels     nsparser.Constraints
+		want       string
+	}{
+		//bypass only waives namespace label
+		{"constraint", []string{"team-a"}, nsparser.Constraints{"cluster": {"c1"}}, `node_load1{cluster=~"^c1$"}`},
+		{"cluster-qualified namespaces", []string{"c1/team-a", "c2/team-b"}, nil,
+			`(node_load1{cluster=~"^c1$"} or node_load1{cluster=~"^c2$"})`},
+		{"unqualified namespace", []string{"team-a"}, nil, `node_load1`},
+		{"no accessible namespace", []string{"c1/team-a"}, nsparser.Constraints{"cluster": {"c2"}},
+			`node_load1{cluster=~"^c2$",namespace="` + noDataValue + `"}`},
+	}
+	for _, c := range cases {
+		s := &scope{namespaces: c.namespaces, labels: c.labels, clusterLabel: "cluster"}
+		e := r.enforcer(up, s)
+		expr, err := promparser.ParseExpr("node_load1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr, err = e.inject(expr); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := expr.String(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	//series of bypassed metrics are filtered by cluster and constraints too
+	s := &scope{namespaces: []string{"c1/team-a"}, labels: nsparser.Constraints{"tenant": {"t1"}}, clusterLabel: "cluster"}
+	series := []struct {
+		labels map[string]interface{}
+		want   bool
+	}{
+		{map[string]interface{}{"__name__": "node_load1", "cluster": "c1", "tenant": "t1"}, true},
+		{map[string]interface{}{"__name__": "node_load1", "cluster": "c2", "tenant": "t1"}, false},
+		{map[string]interface{}{"__name__": "node_load1", "cluster": "c1", "tenant": "t2"}, false},
+	}
+	e := r.enforcer(up, s)
+	for _, c := range series {
+		labels := labelsOf(c.labels)
+		if got := s.allows(e.seriesLabel(labels), labels); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.labels, got, c.want)
+		}
+	}
+	var selectors []string
+	for _, vs := range e.scopeSelectors() {
+		selectors = append(selectors, vs.String())
+	}
+	want := []string{
+		`{__name__=~"^(?:node_.*)$",cluster=~"^c1$",tenant=~"^t1$"}`,
+		`{cluster=~"^c1$",namespace=~"^team-a$",tenant=~"^t1$"}`,
+	}
+	if !reflect.DeepEqual(selectors, want) {
+		t.Errorf("got scope selectors %q, want %q", selectors, want)
+	}
+}
+
+func TestInfoWithoutDataLabelSelector(t *testing.T) {
+	e := &enforcer{nsLabelName: "namespace", namespaces: testNamespaces}
+	branches := &enforcer{branches: []*enforcer{
+		{nsLabelName: "namespace", namespaces: []string{"team-a"}, constraints: nsparser.Constraints{"cluster": {"c1"}}},
+		{nsLabelName: "namespace", namespaces: []string{"team-b"}, constraints: nsparser.Constraints{"cluster": {"c2"}}},
+	}}
+	for _, query := range []string{`info(up)`, `sum(info(rate(x[5m])))`, `up * on(job) group_left() info(up)`} {
+		for _, e := range []*enforcer{e, branches} {
+			expr, err := promparser.ParseExpr(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//target_info would be selected without namespace matcher
+			if _, err := e.inject(expr); err == nil {
+				t.Errorf("%s is not rejected", query)
+			}
+		}
+	}
+	expr, err := promparser.ParseExpr(`info(up, {__name__="target_info"})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr, err = e.inject(expr); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := expr.String(), `info(up{`+testNSMatcher+`}, {__name__="target_info",`+testNSMatcher+`})`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	errRateLimited    = errors.New("rate limit exceeded, retry later")
+	errTooManyQueries = errors.New("too many concurrent queries, retry later")
+)
+
+//tenantLimiter holds token bucket and concurrency slots of one tenant
+type tenantLimiter struct {
+	//limiter is nil if there is no rate limit
+	limiter *rate.Limiter
+	//slots is nil if there is no concurrency limit
+	slots chan struct{}
+}
+
+//idle tells whether limiter is in the same state as a new one, i.e. no slot
+//is taken and the token bucket is full, so that it can be dropped
+func (tl *tenantLimiter) idle() bool {
+	if len(tl.slots) > 0 {
+		return false
+	}
+	return tl.limiter == nil || tl.limiter.Tokens() >= float64(tl.limiter.Burst())
+}
+
+//sweepInterval is the minimum interval between removals of idle limiters
+const sweepInterval = time.Minute
+
+//limiters keeps a tenantLimiter for every tenant seen recently.
+//Idle limiters are removed so that the map does not grow without bound
+type limiters struct {
+	mu        sync.Mutex
+	tenants   map[string]*tenantLimiter
+	lastSweep time.Time
+}
+
+//acquire takes a token and a concurrency slot for the tenant identified by key.
+//The returned function must be called to release the slot once the query finishes
+func (l *limiters) acquire(key string, cfg TenantConfig) (func(), error) {
+	if cfg.RateLimit <= 0 && cfg.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	//limiter is used while the lock is held, so that it is not removed as idle in the meantime
+	tl := l.get(key, cfg)
+	if tl.limiter != nil && !tl.limiter.Allow() {
+		return nil, errRateLimited
+	}
+	if tl.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case tl.slots <- struct{}{}:
+		return func() { <-tl.slots }, nil
+	default:
+		return nil, errTooManyQueries
+	}
+}
+
+//get returns limiter of key, and removes idle limiters of the other keys. l.mu must be held
+func (l *limiters) get(key string, cfg TenantConfig) *tenantLimiter {
+	if l.tenants == nil {
+		l.tenants = map[string]*tenantLimiter{}
+	}
+	if now := time.Now(); now.Sub(l.lastSweep) >= sweepInterval {
+		l.lastSweep = now
+		for k, tl := range l.tenants {
+			if tl.idle() {
+				delete(l.tenants, k)
+			}
+		}
+	}
+	if tl, ok := l.tenants[key]; ok {
+		return tl
+	}
+	tl := &tenantLimiter{}
+	if cfg.RateLimit > 0 {
+		burst := cfg.RateBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		tl.limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), burst)
+	}
+	if cfg.MaxConcurrent > 0 {
+		tl.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	l.tenants[key] = tl
+	return tl
+}
+
+//limiterKey identifies the tenant by user name authenticated by namespace parser,
+//otherwise by the data accessible to the caller. User name sent in request headers
+//is not used, as callers could evade limits by changing it
+func limiterKey(user string, s *scope) string {
+	if user != "" {
+		return "user:" + user
+	}
+	return "namespaces:" + s.key()
+}
@@ -0,0 +1,212 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+func TestLimiters(t *testing.T) {
+	var l limiters
+	cfg := TenantConfig{RateLimit: 0.001, RateBurst: 1, MaxConcurrent: 1}
+	release, err := l.acquire("user:a", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire("user:a", cfg); err != errRateLimited {
+		t.Errorf("got %v, want %v", err, errRateLimited)
+	}
+	//limits of other tenants are separated
+	releaseB, err := l.acquire("user:b", TenantConfig{MaxConcurrent: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire("user:b", TenantConfig{MaxConcurrent: 1}); err != errTooManyQueries {
+		t.Errorf("got %v, want %v", err, errTooManyQueries)
+	}
+	release()
+	releaseB()
+	if _, err := l.acquire("user:c", TenantConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.tenants) != 2 {
+		t.Errorf("got %d limiters, want 2 as there is no limit of user:c", len(l.tenants))
+	}
+
+	//b is idle, a still has to wait for its token
+	l.lastSweep = time.Time{}
+	if _, err := l.acquire("user:d", TenantConfig{MaxConcurrent: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"user:a": true, "user:b": false, "user:d": true} {
+		if _, ok := l.tenants[key]; ok != want {
+			t.Errorf("limiter of %s kept: %v, want %v", key, ok, want)
+		}
+	}
+}
+
+//identityParser counts how many times the caller is identified
+type identityParser struct {
+	cachedParser
+	calls int32
+}
+
+func (p *identityParser) ParseIdentity(req *http.Request) (nsparser.Identity, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return nsparser.Identity{User: req.Header.Get("X-Test-User")}, nil
+}
+
+func TestTenantLimits(t *testing.T) {
+	p := &identityParser{cachedParser: cachedParser{namespaces: []string{"team-a"}}}
+	query := func(r *routes, user, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {"up"}}.Encode(), nil)
+		req.Header.Set("X-Test-User", user)
+		req.Header.Set("X-Grafana-User", header)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	r := newTestRoutes(t, p, &Config{})
+	query(r, "u1", "")
+	if p.calls != 0 {
+		t.Errorf("caller is identified %d times without tenant settings", p.calls)
+	}
+
+	r = newTestRoutes(t, p, &Config{
+		Identity: IdentityConfig{UserHeader: "X-Grafana-User"},
+		Tenants:  TenantsConfig{Default: TenantConfig{RateLimit: 0.001, RateBurst: 1}},
+	})
+	cases := []struct {
+		user   string
+		header string
+		want   int
+	}{
+		{"u1", "", http.StatusOK},
+		{"u1", "", http.StatusTooManyRequests},
+		{"u2", "", http.StatusOK},
+		//user names in header share the limit of the accessible namespaces
+		{"", "h1", http.StatusOK},
+		{"", "h2", http.StatusTooManyRequests},
+	}
+	for _, c := range cases {
+		if got := query(r, c.user, c.header); got != c.want {
+			t.Errorf("user %q, header %q: got status %d, want %d", c.user, c.header, got, c.want)
+		}
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	cfg := &Config{Tenants: TenantsConfig{
+		Default: TenantConfig{RateLimit: 10, RateBurst: 20, MaxRange: Duration(24 * time.Hour), MaxWindow: Duration(time.Hour)},
+		Users:   map[string]TenantConfig{"u1": {RateLimit: 50}},
+		Groups: map[string]TenantConfig{
+			"operators": {MaxConcurrent: 10},
+			"analysts":  {MaxConcurrent: 2, MaxRange: Duration(48 * time.Hour)},
+		},
+	}}
+	cases := []struct {
+		name string
+		id   nsparser.Identity
+		want TenantConfig
+	}{
+		{"default", nsparser.Identity{User: "u2"}, cfg.Tenants.Default},
+		//entries only change the limits they set
+		{"group", nsparser.Identity{Groups: []string{"operators"}},
+			TenantConfig{RateLimit: 10, RateBurst: 20, MaxConcurrent: 10, MaxRange: Duration(24 * time.Hour), MaxWindow: Duration(time.Hour)}},
+		{"first group wins", nsparser.Identity{Groups: []string{"operators", "analysts"}},
+			TenantConfig{RateLimit: 10, RateBurst: 20, MaxConcurrent: 10, MaxRange: Duration(48 * time.Hour), MaxWindow: Duration(time.Hour)}},
+		{"user over group", nsparser.Identity{User: "u1", Groups: []string{"analysts"}},
+			TenantConfig{RateLimit: 50, RateBurst: 20, MaxConcurrent: 2, MaxRange: Duration(48 * time.Hour), MaxWindow: Duration(time.Hour)}},
+	}
+	for _, c := range cases {
+		if got := cfg.tenant(c.id); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	p := &identityParser{cachedParser: cachedParser{namespaces: []string{"team-a"}}}
+	cases := []struct {
+		user    string
+		trusted bool
+		want    nsparser.Identity
+	}{
+		//headers of authenticated callers are ignored, as clients can set any header
+		{"u1", false, nsparser.Identity{User: "u1"}},
+		{"u1", true, nsparser.Identity{User: "u1", Groups: []string{"operators"}}},
+		{"", false, nsparser.Identity{User: "h1", Groups: []string{"operators"}}},
+	}
+	for _, c := range cases {
+		r := newTestRoutes(t, p, &Config{Identity: IdentityConfig{
+			UserHeader:   "X-Grafana-User",
+			GroupsHeader: "X-Forwarded-Groups",
+			TrustHeaders: c.trusted,
+		}})
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		req.Header.Set("X-Test-User", c.user)
+		req.Header.Set("X-Grafana-User", "h1")
+		req.Header.Set("X-Forwarded-Groups", "operators")
+		if got, _ := r.identity(req); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("user %q, trusted %v: got %+v, want %+v", c.user, c.trusted, got, c.want)
+		}
+	}
+}
+
+func TestIAMUserResolvedOnce(t *testing.T) {
+	var uidCalls int32
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/auth/userInfo":
+			atomic.AddInt32(&uidCalls, 1)
+			fmt.Fprint(w, `{"sub":"u1"}`)
+		case "/identity/api/v1/users/u1/getTeamResources":
+			fmt.Fprint(w, `[{"namespaceId":"team-a","highestRole":"Viewer"}]`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(iam.Close)
+	file := filepath.Join(t.TempDir(), "ns-config.yaml")
+	conf := fmt.Sprintf("type: ibm-cs-iam\nparas:\n  uidURL: %s\n  userInfoURL: %s\n", iam.URL, iam.URL)
+	if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRoutes(t, nsparser.NewNSParser(file), &Config{Tenants: TenantsConfig{Default: TenantConfig{MaxConcurrent: 1}}})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {"up"}}.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if uidCalls != 1 {
+		t.Errorf("user id is resolved %d times in one request, want 1", uidCalls)
+	}
+}
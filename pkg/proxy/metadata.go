@@ -0,0 +1,99 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+//metadata returns metadata of metrics which exist in namespaces accessible to the caller
+func (r *routes) metadata(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	up := r.upstreamFor(req)
+	if s.unrestricted() {
+		up.handler.ServeHTTP(w, req)
+		return
+	}
+	names, err := metricNames(req.Context(), up, r.enforcer(up, s))
+	if err != nil {
+		writeFetchError(w, err)
+		return
+	}
+	filterResponse(w, req, up, func(data interface{}) interface{} {
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return data
+		}
+		for name := range obj {
+			if !names[name] {
+				delete(obj, name)
+			}
+		}
+		return obj
+	})
+}
+
+//metricNames returns names of metrics which have series accessible through enforcer,
+//looking up the same series as label values endpoints do
+func metricNames(ctx context.Context, up *upstream, e *enforcer) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, selector := range e.scopeSelectors() {
+		if err := labelValues(ctx, up, selector, names); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+//labelValues adds names of metrics selected by selector to names
+func labelValues(ctx context.Context, up *upstream, selector *promparser.VectorSelector, names map[string]bool) error {
+	q := url.Values{"match[]": {selector.String()}}
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/label/"+promlabels.MetricName+"/values?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := up.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var parsed struct {
+		Status string   `json:"status"`
+		Data   []string `json:"data"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &parsed) != nil || parsed.Status != "success" {
+		return &upstreamError{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	for _, name := range parsed.Data {
+		names[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "ocpthanos_proxy"
+
+var (
+	upstreamAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_attempts_total",
+		Help:      "Number of attempts to send requests to upstream endpoints by outcome.",
+	}, []string{"upstream", "endpoint", "outcome"})
+	upstreamEndpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_endpoint_up",
+		Help:      "Whether upstream endpoint passed the last health check.",
+	}, []string{"upstream", "endpoint"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamAttempts, upstreamEndpointUp)
+}
@@ -17,14 +17,48 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	promparser "github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
 )
 
+//Server is the HTTP server of the proxy. It tracks readiness so that
+//the proxy can be drained before it is shut down
+type Server struct {
+	*http.Server
+	ready int32
+}
+
+//Options holds the tunables of the proxy server and its upstream requests.
+//A zero value means no limit
+type Options struct {
+	//ReadTimeout is the maximum duration for reading the entire client request
+	ReadTimeout time.Duration
+	//WriteTimeout is the maximum duration before timing out writes of the response.
+	//It should be longer than UpstreamTimeout
+	WriteTimeout time.Duration
+	//IdleTimeout is the maximum amount of time to wait for the next request on a keep-alive connection
+	IdleTimeout time.Duration
+	//UpstreamResponseHeaderTimeout is the maximum time to wait for thanos response headers
+	UpstreamResponseHeaderTimeout time.Duration
+	//UpstreamTimeout is the deadline of a request forwarded to thanos.
+	//The timeout parameter sent by client is capped by it
+	UpstreamTimeout time.Duration
+	//EnableExperimentalFunctions lets queries use functions which are experimental in
+	//Prometheus, e.g. info() and limitk(). Upstream must enable them too
+	EnableExperimentalFunctions bool
+	//Config is the policy configuration loaded by LoadConfig
+	Config *Config
+}
+
 //StartAndServe start HTTP server and forward request to backend server
 func StartAndServe(listenAddr string,
 	urlPrefix string,
@@ -32,23 +66,44 @@ func StartAndServe(listenAddr string,
 	thanosTokenFile string,
 	nsparser nsparser.NSParser,
 	nsLabelName string,
-	errCh chan<- error) (*http.Server, error) {
-	url, err := url.Parse(thanosAddr)
-	if err != nil {
-		return nil, err
+	opts Options,
+	errCh chan<- error) (*Server, error) {
+	if opts.Config == nil {
+		opts.Config = &Config{}
 	}
+	//the parser of Prometheus is only configured by this global
+	promparser.EnableExperimentalFunctions = opts.EnableExperimentalFunctions
 	// create handlers
 	routes := &routes{
-		thanosURL:       url,
-		thanosTokenFile: thanosTokenFile,
-		nsparser:        nsparser,
-		nsLabelName:     nsLabelName,
+		nsparser: nsparser,
+		opts:     opts,
 	}
-	routes.init()
+	err := routes.init(UpstreamConfig{
+		Name:        defaultUpstreamName,
+		URL:         thanosAddr,
+		TokenFile:   thanosTokenFile,
+		NSLabelName: nsLabelName,
+		TLS:         TLSConfig{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{ready: 1}
 	mux := http.NewServeMux()
 	mux.Handle(urlPrefix, routes)
+	mux.HandleFunc("/-/healthy", server.healthy)
+	mux.HandleFunc("/-/ready", server.readiness)
+	if opts.Config.API.Explain.Enabled {
+		mux.HandleFunc("/-/explain", routes.explain)
+	}
+	mux.Handle("/metrics", promhttp.Handler())
 	// create server
-	server := &http.Server{Handler: mux}
+	server.Server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		IdleTimeout:  opts.IdleTimeout,
+	}
 	l, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return nil, err
@@ -59,3 +114,37 @@ func StartAndServe(listenAddr string,
 	}()
 	return server, nil
 }
+
+//GracefulShutdown marks the server as not ready, waits for delay so that
+//the Service stops sending new traffic to it, and then shuts the server down.
+//In-flight requests are given up to timeout to finish before connections are closed.
+func (s *Server) GracefulShutdown(delay time.Duration, timeout time.Duration) error {
+	atomic.StoreInt32(&s.ready, 0)
+	if delay > 0 {
+		log.Printf("Readiness set to failed, waiting %v before shutting down", delay)
+		time.Sleep(delay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+//healthy reports that the process is alive
+func (s *Server) healthy(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+//readiness reports whether the server accepts new traffic
+func (s *Server) readiness(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
@@ -0,0 +1,138 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//newShutdownServer serves readiness and /slow, which blocks until release is closed
+func newShutdownServer(t *testing.T, started chan<- struct{}, release <-chan struct{}) (*Server, string) {
+	s := &Server{ready: 1}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/ready", s.readiness)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})
+	s.Server = &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(func() { s.Close() })
+	return s, "http://" + l.Addr().String()
+}
+
+//shutdownClient does not leave idle or unused connections, which Shutdown could wait for
+var shutdownClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func readyStatus(t *testing.T, base string) int {
+	resp, err := shutdownClient.Get(base + "/-/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, base := newShutdownServer(t, started, release)
+	if code := readyStatus(t, base); code != http.StatusOK {
+		t.Fatalf("ready before shutdown = %d", code)
+	}
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := shutdownClient.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		slow <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.GracefulShutdown(500*time.Millisecond, 5*time.Second) }()
+	//readiness fails while the server still serves during the delay
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for readyStatus(t, base) != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("ready did not turn to 503 during shutdown delay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//shutdown waits for the in-flight request
+	time.Sleep(700 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v before in-flight request finished", err)
+	default:
+	}
+	close(release)
+	res := <-slow
+	if res.err != nil || res.code != http.StatusOK || res.body != "done" {
+		t.Fatalf("in-flight request = %d %q %v", res.code, res.body, res.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("GracefulShutdown() = %v", err)
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s, base := newShutdownServer(t, started, release)
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := shutdownClient.Get(base + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	<-started
+
+	if err := s.GracefulShutdown(0, 100*time.Millisecond); err == nil {
+		t.Fatal("GracefulShutdown() did not report in-flight request exceeding timeout")
+	}
+	//connections are closed once timeout is exceeded
+	select {
+	case err := <-slow:
+		if err == nil {
+			t.Fatal("in-flight request succeeded after its connection was closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("in-flight request not cut after shutdown timeout")
+	}
+}
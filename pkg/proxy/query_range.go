@@ -0,0 +1,166 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+//send forwards request to upstream. Range queries are evaluated by
+//the proxy itself when results cache or splitting is enabled
+func (r *routes) send(w http.ResponseWriter, req *http.Request, up *upstream, s *scope) {
+	if !s.unrestricted() && strings.HasSuffix(req.URL.Path, "/query_exemplars") {
+		filterExemplars(w, req, up, s, r.enforcer(up, s))
+		return
+	}
+	rangeEnabled := r.cache != nil || r.opts.Config.Split.Interval > 0
+	if rangeEnabled && strings.HasSuffix(req.URL.Path, "/query_range") && !atStartOrEnd(req.URL.Query().Get("query")) {
+		r.queryRange(w, req, up, s)
+		return
+	}
+	up.handler.ServeHTTP(w, req)
+}
+
+//atStartOrEnd tells whether query uses @ start() or @ end(). They are resolved against the range
+//of the query, so results of sub-queries and of other ranges can not be merged
+func atStartOrEnd(query string) bool {
+	expr, err := promparser.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+	found := false
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		switch n := node.(type) {
+		case *promparser.VectorSelector:
+			found = found || n.StartOrEnd != 0
+		case *promparser.SubqueryExpr:
+			found = found || n.StartOrEnd != 0
+		}
+		return nil
+	})
+	return found
+}
+
+//queryRange evaluates range query through results cache. Parts of the range
+//found in cache are reused and only the missing parts are evaluated by upstream
+func (r *routes) queryRange(w http.ResponseWriter, req *http.Request, up *upstream, s *scope) {
+	//req.Form may hold the query before namespaces are injected, so URL is used
+	q := req.URL.Query()
+	startTime, err1 := parseTime(q.Get("start"))
+	endTime, err2 := parseTime(q.Get("end"))
+	stepDuration, err3 := parseDuration(q.Get("step"))
+	if err1 != nil || err2 != nil || err3 != nil || stepDuration <= 0 || endTime.Before(startTime) {
+		//let upstream report invalid parameters
+		up.handler.ServeHTTP(w, req)
+		return
+	}
+	start := model.TimeFromUnixNano(startTime.UnixNano())
+	step := model.Time(stepDuration / time.Millisecond)
+	if step <= 0 {
+		step = 1
+	}
+	//the last point evaluated by Prometheus
+	end := start + (model.TimeFromUnixNano(endTime.UnixNano())-start)/step*step
+	//the other parameters, e.g. dedup or max_source_resolution, are passed on to sub-queries
+	params := url.Values{}
+	for k, v := range q {
+		if k != "start" && k != "end" {
+			params[k] = v
+		}
+	}
+	if r.cache == nil {
+		res, err := r.evalRange(req.Context(), up, params, start, end, step)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		writeRange(w, res)
+		return
+	}
+	//parameters may change the result, except timeout
+	keyParams := url.Values{}
+	for k, v := range params {
+		if k != "timeout" {
+			keyParams[k] = v
+		}
+	}
+	key := strings.Join([]string{
+		up.name,
+		keyParams.Encode(),
+		s.key(),
+		step.String(),
+		(start % step).String(),
+	}, "\x00")
+
+	extents := r.cache.get(key)
+	var results []*rangeResult
+	for _, e := range extents {
+		if e.end >= start && e.start <= end {
+			results = append(results, trimResult(e.result, start, end))
+		}
+	}
+	//samples newer than cutoff may still change, e.g. by late scrapes
+	cutoff := model.TimeFromUnixNano(time.Now().Add(-r.cache.maxFreshness).UnixNano())
+	var fresh []extent
+	for _, m := range missingRanges(start, end, step, extents) {
+		res, err := r.evalRange(req.Context(), up, params, m[0], m[1], step)
+		if err != nil {
+			writeFetchError(w, err)
+			return
+		}
+		results = append(results, res)
+		cacheEnd := m[0] + (cutoff-m[0])/step*step
+		if cacheEnd > m[1] {
+			cacheEnd = m[1]
+		}
+		if cutoff >= m[0] && len(res.warnings) == 0 {
+			fresh = append(fresh, extent{
+				start:   m[0],
+				end:     cacheEnd,
+				expires: time.Now().Add(r.cache.ttl),
+				result:  trimResult(res, m[0], cacheEnd),
+			})
+		}
+	}
+	r.cache.put(key, step, fresh)
+	writeRange(w, mergeResults(results...))
+}
+
+//writeFetchError passes on upstream error response, or reports why upstream could not be reached
+func writeFetchError(w http.ResponseWriter, err error) {
+	var upErr *upstreamError
+	switch {
+	case errors.As(err, &upErr):
+		if upErr.contentType != "" {
+			w.Header().Set("Content-Type", upErr.contentType)
+		}
+		w.WriteHeader(upErr.code)
+		_, _ = w.Write(upErr.body)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusServiceUnavailable, errorTimeout, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, errorUnavailable, err.Error())
+	}
+}
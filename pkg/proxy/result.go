@@ -0,0 +1,170 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+//rangeResponse is the response body of Prometheus range query API
+type rangeResponse struct {
+	Status    string    `json:"status"`
+	Data      rangeData `json:"data"`
+	ErrorType string    `json:"errorType,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+}
+
+type rangeData struct {
+	ResultType string                `json:"resultType"`
+	Result     []*model.SampleStream `json:"result"`
+}
+
+//rangeResult is the matrix returned by range query over [start, end]
+type rangeResult struct {
+	streams  []*model.SampleStream
+	warnings []string
+}
+
+//upstreamError is a failed response of upstream which is passed on to client as it is
+type upstreamError struct {
+	code        int
+	contentType string
+	body        []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d: %s", e.code, e.body)
+}
+
+//fetchRange sends range query to upstream and parses the matrix it returns
+func fetchRange(ctx context.Context, up *upstream, params url.Values, start, end model.Time) (*rangeResult, error) {
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("start", formatTime(start))
+	q.Set("end", formatTime(end))
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/query_range?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := up.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	var parsed rangeResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+	if parsed.Status != "success" || parsed.Data.ResultType != model.ValMatrix.String() {
+		return nil, &upstreamError{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	return &rangeResult{streams: parsed.Data.Result, warnings: parsed.Warnings}, nil
+}
+
+//writeRange responds with the matrix in Prometheus range query format
+func writeRange(w http.ResponseWriter, res *rangeResult) {
+	streams := res.streams
+	if streams == nil {
+		streams = []*model.SampleStream{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rangeResponse{
+		Status:   "success",
+		Data:     rangeData{ResultType: model.ValMatrix.String(), Result: streams},
+		Warnings: res.warnings,
+	})
+}
+
+//mergeResults merges matrices of adjacent or overlapping ranges.
+//Samples of the same series are sorted by time and deduplicated
+func mergeResults(results ...*rangeResult) *rangeResult {
+	merged := &rangeResult{}
+	series := map[model.Fingerprint]*model.SampleStream{}
+	warnings := map[string]bool{}
+	for _, res := range results {
+		for _, w := range res.warnings {
+			if !warnings[w] {
+				warnings[w] = true
+				merged.warnings = append(merged.warnings, w)
+			}
+		}
+		for _, s := range res.streams {
+			fp := s.Metric.Fingerprint()
+			existing, ok := series[fp]
+			if !ok {
+				existing = &model.SampleStream{Metric: s.Metric}
+				series[fp] = existing
+				merged.streams = append(merged.streams, existing)
+			}
+			existing.Values = append(existing.Values, s.Values...)
+		}
+	}
+	for _, s := range merged.streams {
+		sort.Slice(s.Values, func(i, j int) bool { return s.Values[i].Timestamp < s.Values[j].Timestamp })
+		deduped := s.Values[:0]
+		for i, v := range s.Values {
+			if i == 0 || v.Timestamp != s.Values[i-1].Timestamp {
+				deduped = append(deduped, v)
+			}
+		}
+		s.Values = deduped
+	}
+	sort.Slice(merged.streams, func(i, j int) bool {
+		return merged.streams[i].Metric.String() < merged.streams[j].Metric.String()
+	})
+	return merged
+}
+
+//trimResult returns samples of res within [start, end]
+func trimResult(res *rangeResult, start, end model.Time) *rangeResult {
+	trimmed := &rangeResult{warnings: res.warnings}
+	for _, s := range res.streams {
+		var values []model.SamplePair
+		for _, v := range s.Values {
+			if v.Timestamp >= start && v.Timestamp <= end {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			trimmed.streams = append(trimmed.streams, &model.SampleStream{Metric: s.Metric, Values: values})
+		}
+	}
+	return trimmed
+}
+
+func formatTime(t model.Time) string {
+	return strconv.FormatFloat(float64(t)/1000, 'f', -1, 64)
+}
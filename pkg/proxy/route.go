@@ -17,29 +17,34 @@
 package proxy
 
 import (
-	"crypto/tls"
-	"io/ioutil"
-	"net"
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/common/model"
 	promparser "github.com/prometheus/prometheus/promql/parser"
 
 	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
 )
 
 type routes struct {
-	//handler is instance of httputil.ReverseProxy
-	handler http.Handler
-	mux     *http.ServeMux
+	mux *http.ServeMux
 
-	nsparser        nsparser.NSParser
-	nsLabelName     string
-	thanosTokenFile string
-	thanosURL       *url.URL
+	nsparser  nsparser.NSParser
+	upstreams map[string]*upstream
+	opts      Options
+	limiters  limiters
+	bypass    []bypassRule
+	labels    []labelRule
+	relabel   string
+	denied    string
+	//cache is nil if results cache is disabled
+	cache *resultsCache
 }
 
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -48,117 +53,326 @@ func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	req = req.WithContext(nsparser.WithRequestCache(req.Context()))
+	if r.opts.UpstreamTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), r.opts.UpstreamTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+		r.capTimeout(req)
+	}
 	r.mux.ServeHTTP(w, req)
 }
 
-//1. custom httputil.ReverseProxy
+//capTimeout limits the timeout parameter sent by client to UpstreamTimeout
+//so that one heavy query can not hold connections forever
+func (r *routes) capTimeout(req *http.Request) {
+	q := req.URL.Query()
+	timeout := q.Get("timeout")
+	if timeout == "" || r.opts.UpstreamTimeout <= 0 {
+		return
+	}
+	d, err := parseDuration(timeout)
+	if err == nil && d <= r.opts.UpstreamTimeout {
+		return
+	}
+	q.Set("timeout", model.Duration(r.opts.UpstreamTimeout).String())
+	req.URL.RawQuery = q.Encode()
+}
+
+//1. create upstreams and their httputil.ReverseProxy
 //2. register handler functions
-func (r *routes) init() {
-	proxy := httputil.NewSingleHostReverseProxy(r.thanosURL)
-	// it is http.DefaultTransport with extra tls Config
-	if r.thanosURL.Scheme == "https" {
-		tlsConfig := &tls.Config{
-			//nolint:gosec
-			InsecureSkipVerify: true,
-		}
-		transport := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       tlsConfig,
-		}
-		proxy.Transport = transport
-	}
-
-	//modify default director to add thanos access token and update req.Host
-	director := func(req *http.Request) {
-		req.URL.Scheme = r.thanosURL.Scheme
-		req.URL.Host = r.thanosURL.Host
-		//update Host so that it can pass OCP Router when testing locally
-		req.Host = r.thanosURL.Host
-		targetQuery := r.thanosURL.RawQuery
-		req.URL.Path = singleJoiningSlash(r.thanosURL.Path, req.URL.Path)
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
-		}
-		//add Authorization heander for token
-		tokenBytes, err := ioutil.ReadFile(r.thanosTokenFile)
+func (r *routes) init(defaultUpstream UpstreamConfig) error {
+	r.upstreams = map[string]*upstream{}
+	configs := []UpstreamConfig{defaultUpstream}
+	for _, cfg := range r.opts.Config.Upstreams {
+		if cfg.Name == defaultUpstreamName {
+			configs[0] = mergeUpstreamConfig(defaultUpstream, cfg)
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+	for _, cfg := range configs {
+		if _, ok := r.upstreams[cfg.Name]; ok || cfg.Name == "" {
+			return fmt.Errorf("upstream name %q is empty or duplicated", cfg.Name)
+		}
+		if cfg.NSLabelName == "" {
+			cfg.NSLabelName = defaultUpstream.NSLabelName
+		}
+		up, err := newUpstream(cfg, r.opts)
 		if err != nil {
-			tokenBytes = []byte("")
+			return err
 		}
-		thanosToken := string(tokenBytes)
-		req.Header.Set("Authorization", "Bearer "+thanosToken)
+		r.upstreams[cfg.Name] = up
 	}
-	proxy.Director = director
-	r.handler = proxy
+	for _, rule := range r.opts.Config.Routing {
+		if _, ok := r.upstreams[rule.Upstream]; !ok {
+			return fmt.Errorf("routing rule refers to unknown upstream %q", rule.Upstream)
+		}
+	}
+	if r.opts.Config.Cache.MaxSize > 0 {
+		r.cache = newResultsCache(r.opts.Config.Cache)
+	}
+	relabel, err := r.opts.Config.relabelPolicy()
+	if err != nil {
+		return err
+	}
+	r.relabel = relabel
+	if r.denied, err = r.opts.Config.deniedPolicy(); err != nil {
+		return err
+	}
+	bypass, err := newBypassRules(r.opts.Config.Enforcement.Bypass)
+	if err != nil {
+		return err
+	}
+	r.bypass = bypass
+	labels, err := newLabelRules(r.opts.Config.Enforcement.Labels)
+	if err != nil {
+		return err
+	}
+	r.labels = labels
 
 	//add handler for different endpoints to meet requirements from Grafana
 	mux := http.NewServeMux()
 	r.mux = mux
 	mux.Handle("/api/v1/query", r.wrapMethod(r.query))
 	mux.Handle("/api/v1/query_range", r.wrapMethod(r.query))
+	mux.Handle("/api/v1/query_exemplars", r.wrapMethod(r.query))
 	mux.Handle("/api/v1/series", r.wrapMethod(r.query))
-	mux.Handle("/api/v1/label/", r.wrapMethod(r.forward))
-
+	mux.Handle("/api/v1/labels", r.wrapMethod(r.query))
+	mux.Handle("/api/v1/label/", r.wrapMethod(r.query))
+	mux.Handle("/api/v1/targets", r.wrapMethod(r.targets))
+	mux.Handle("/api/v1/rules", r.wrapMethod(r.rules))
+	mux.Handle("/api/v1/alerts", r.wrapMethod(r.alerts))
+	mux.Handle("/api/v1/metadata", r.wrapMethod(r.metadata))
+	//the other endpoints do not return tenant data, or are not supported for tenants yet
+	mux.Handle("/api/v1/", r.wrapMethod(r.global))
+	return nil
 }
 
-//query injects namespaces into PromQL query string
+//query injects namespaces into PromQL query string, or into match[] selectors
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	key, tenant := r.tenant(req, s)
+	release, err := r.limiters.acquire(key, tenant)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, errorTooManyRequests, err.Error())
+		return
+	}
+	defer release()
+	q := req.URL.Query()
+	queryKey, otherKey := queryParams(req.URL.Path)
+	//the other parameter is dropped, as upstream may read it and it is not restricted
+	delete(q, otherKey)
+	exprs := make([]promparser.Expr, 0, len(q[queryKey]))
+	for _, query := range q[queryKey] {
+		expr, err := promparser.ParseExpr(query)
+		if err != nil {
+			http.Error(w, "failed to parse query string", http.StatusBadRequest)
+			return
+		}
+		exprs = append(exprs, expr)
+	}
+	up := r.upstreamFor(req)
+	e := r.enforcer(up, s)
+	var rep *report
+	if r.denied == deniedNarrow {
+		//values dropped from selectors are reported to the caller
+		rep = &report{}
+		e.collect(rep)
+	}
+	var costExpr promparser.Expr
+	if queryKey == "query" && len(exprs) > 0 {
+		costExpr = exprs[0]
+	}
+	if err := checkQueryCost(req, costExpr, tenant); err != nil {
+		writeError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	//match[] selectors are checked too, e.g. {__name__=~".+"} is as expensive in series lookup
+	for _, expr := range exprs {
+		if err := checkDenyList(expr, r.opts.Config.DenyList); err != nil {
+			writeError(w, http.StatusBadRequest, errorBadData, err.Error())
+			return
+		}
+	}
+	if s.unrestricted() {
+		r.send(w, req, up, s)
+		return
+	}
+	updated := make([]string, 0, len(exprs))
+	if len(exprs) == 0 {
+		if !strings.Contains(req.URL.Path, "/label") {
+			http.Error(w, "failed to parse query string", http.StatusBadRequest)
+			return
+		}
+		//limit label names and values to series accessible to the caller
+		for _, vs := range e.scopeSelectors() {
+			updated = append(updated, vs.String())
+		}
+	}
+	for _, expr := range exprs {
+		if vs, ok := expr.(*promparser.VectorSelector); ok && queryKey != "query" && len(e.branches) > 0 {
+			//match[] selectors are united by upstream, so there is one per branch instead of or
+			selectors, err := enforceBranches(vs, e.branches)
+			if err != nil {
+				writeInjectError(w, err)
+				return
+			}
+			for _, c := range selectors {
+				updated = append(updated, c.String())
+			}
+			continue
+		}
+		expr, err := e.inject(expr)
+		if err != nil {
+			writeInjectError(w, err)
+			return
+		}
+		updated = append(updated, expr.String())
+	}
+	q[queryKey] = updated
+	req.URL.RawQuery = q.Encode()
+	if rep != nil {
+		for _, m := range rep.dropped() {
+			w.Header().Add(droppedHeader, m)
+		}
+	}
+	r.send(w, req, up, s)
+}
+
+//queryParams returns the parameter holding PromQL of endpoint and the one which is not used by it:
+//query of query endpoints, or match[] selectors of series, labels and label values endpoints
+func queryParams(path string) (string, string) {
+	for _, suffix := range []string{"/query", "/query_range", "/query_exemplars"} {
+		if strings.HasSuffix(path, suffix) {
+			return "query", "match[]"
+		}
+	}
+	return "match[]", "query"
+}
+
+//writeInjectError responds why query can not be restricted to the scope of the caller
+func writeInjectError(w http.ResponseWriter, err error) {
+	var d *denial
+	if errors.As(err, &d) {
+		writeError(w, http.StatusForbidden, errorForbidden, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, errorBadData, err.Error())
+}
+
+//global forwards requests of endpoints which do not return tenant data.
+//Tenants can only call the ones allowed in proxy configuration
+func (r *routes) global(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	if !s.unrestricted() && !contains(r.opts.Config.API.globalEndpoints(), req.URL.Path) {
+		writeError(w, http.StatusForbidden, errorForbidden,
+			fmt.Sprintf("%s is not available to users who can not access all namespaces", req.URL.Path))
+		return
+	}
+	r.upstreamFor(req).handler.ServeHTTP(w, req)
+}
+
+//namespaces gets namespaces accessible to the caller. If there is none, error is responded and false is returned
+func (r *routes) namespaces(w http.ResponseWriter, req *http.Request) ([]string, bool) {
 	namespaces, err := r.nsparser.ParseNamespaces(req)
 	if err != nil {
 		http.Error(w, "No namespace accessible for user. details: "+err.Error(), http.StatusForbidden)
-		return
+		return nil, false
 
 	}
 	if len(namespaces) == 0 {
 		http.Error(w, "No namespace accessible for user.", http.StatusForbidden)
-		return
+		return nil, false
+	}
+	return namespaces, true
+}
+
+//enforcer creates enforcer injecting scope of the caller into queries sent to upstream
+func (r *routes) enforcer(up *upstream, s *scope) *enforcer {
+	e := &enforcer{
+		nsLabelName: up.nsLabelName,
+		namespaces:  s.namespaces,
+		constraints: s.labels,
+		bypass:      r.bypass,
+		labels:      r.labels,
+		relabel:     r.relabel,
+		denied:      r.denied,
+	}
+	groups := groupNamespaces(s.namespaces)
+	if len(groups) == 1 && groups[0].clusters == nil {
+		return e
+	}
+	for _, g := range groups {
+		if b, ok := e.branch(g, s.clusterLabel); ok {
+			e.branches = append(e.branches, b)
+		}
+	}
+	if len(e.branches) == 0 {
+		//no cluster is accessible, so selectors select no data
+		e.namespaces = nil
+		return e
 	}
+	if len(e.branches) == 1 {
+		return e.branches[0]
+	}
+	return e
+}
+
+func isAllNamespaces(namespaces []string) bool {
 	for _, ns := range namespaces {
 		if ns == nsparser.AllNamespaces {
-			r.handler.ServeHTTP(w, req)
-			return
+			return true
 		}
 	}
-	var queryKey string
-	var query string
-	if query = req.FormValue("query"); query != "" {
-		queryKey = "query"
-	} else if query = req.FormValue("match[]"); query != "" {
-		queryKey = "match[]"
+	return false
+}
+
+//tenant returns the limiter key and settings of the caller. The caller is
+//only identified if tenant settings are configured, as namespace parser may
+//need extra requests to tell who the caller is
+func (r *routes) tenant(req *http.Request, s *scope) (string, TenantConfig) {
+	if !r.opts.Config.hasTenants() {
+		return "", TenantConfig{}
 	}
-	if err != nil {
-		http.Error(w, "failed to parse namespaces. Details: "+err.Error(), http.StatusBadRequest)
-		return
+	id, authenticated := r.identity(req)
+	return limiterKey(authenticated, s), r.opts.Config.tenant(id)
+}
+
+//identity tells who the caller is. The namespace parser is asked first,
+//and request headers configured in proxy configuration are used as fallback.
+//The user name authenticated by namespace parser is returned too, it is empty
+//if the parser can not tell it
+func (r *routes) identity(req *http.Request) (nsparser.Identity, string) {
+	var id nsparser.Identity
+	if p, ok := r.nsparser.(nsparser.IdentityParser); ok {
+		if parsed, err := p.ParseIdentity(req); err == nil {
+			id = parsed
+		}
 	}
-	expr, err := promparser.ParseExpr(query)
-	if err != nil {
-		http.Error(w, "failed to parse query string", http.StatusBadRequest)
-		return
+	authenticated := id.User
+	cfg := r.opts.Config.Identity
+	//headers are set by client, so they can not override who the parser authenticated
+	if authenticated != "" && !cfg.TrustHeaders {
+		return id, authenticated
 	}
-	err = setRecursive(expr, r.nsLabelName, namespaces)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if id.User == "" && cfg.UserHeader != "" {
+		id.User = req.Header.Get(cfg.UserHeader)
 	}
-	updatedQuery := expr.String()
-	q := req.URL.Query()
-	q.Set(queryKey, updatedQuery)
-	req.URL.RawQuery = q.Encode()
-	r.handler.ServeHTTP(w, req)
+	if len(id.Groups) == 0 && cfg.GroupsHeader != "" {
+		for _, g := range strings.Split(req.Header.Get(cfg.GroupsHeader), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	}
+	return id, authenticated
 }
 
 //wrap our function as http handler
@@ -168,9 +382,27 @@ func (r *routes) wrapMethod(h http.HandlerFunc) http.Handler {
 	})
 }
 
-//forward forwards request directly without any change
-func (r *routes) forward(w http.ResponseWriter, req *http.Request) {
-	r.handler.ServeHTTP(w, req)
+//parseTime parses time the same way as Prometheus HTTP API does:
+//either float unix timestamp or RFC3339 time
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+//parseDuration parses duration the same way as Prometheus HTTP API does:
+//either float seconds or Prometheus duration string
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(d), nil
 }
 
 //copied from httputil for customizing Director of http.ReverseProxy
@@ -0,0 +1,334 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	promparser "github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//TestMain enables experimental functions, as the proxy does with --enable-experimental-functions,
+//so that their injection is tested
+func TestMain(m *testing.M) {
+	promparser.EnableExperimentalFunctions = true
+	os.Exit(m.Run())
+}
+
+//cachedParser returns the same slices to every request, like a parser caching its results
+type cachedParser struct {
+	namespaces []string
+	labels     nsparser.Constraints
+}
+
+func (p *cachedParser) ParseNamespaces(req *http.Request) ([]string, error) {
+	return p.namespaces, nil
+}
+
+func (p *cachedParser) ParseConstraints(req *http.Request) (nsparser.Constraints, error) {
+	return p.labels, nil
+}
+
+//newTestRoutes creates routes forwarding to upstream which returns
+//the queries it receives in header X-Query
+func newTestRoutes(t *testing.T, p nsparser.NSParser, cfg *Config) *routes {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, q := range append(req.URL.Query()["query"], req.URL.Query()["match[]"]...) {
+			w.Header().Add("X-Query", q)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	return routesTo(t, upstream.URL, p, cfg)
+}
+
+//routesTo creates routes forwarding to the upstream at url
+func routesTo(t *testing.T, url string, p nsparser.NSParser, cfg *Config) *routes {
+	r := &routes{nsparser: p, opts: Options{Config: cfg}}
+	if err := r.init(UpstreamConfig{Name: defaultUpstreamName, URL: url, NSLabelName: "namespace"}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestConcurrentInjection(t *testing.T) {
+	p := &cachedParser{
+		namespaces: []string{"team-a", "team-b"},
+		labels:     nsparser.Constraints{"cluster": {"c1"}},
+	}
+	r := newTestRoutes(t, p, &Config{})
+	cases := map[string]string{
+		`up`:                                 `up{cluster=~"^c1$",namespace=~"^team-a$|^team-b$"}`,
+		`sum(rate(http_requests_total[5m]))`: `sum(rate(http_requests_total{cluster=~"^c1$",namespace=~"^team-a$|^team-b$"}[5m]))`,
+		`up{namespace="team-a"} / on() group_left() count(kube_pod_info)`: `up{cluster=~"^c1$",namespace="team-a"} / on () group_left () count(kube_pod_info{cluster=~"^c1$",namespace=~"^team-a$|^team-b$"})`,
+	}
+
+	const workers, requests = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*requests*len(cases))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				for query, want := range cases {
+					req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+					rec := httptest.NewRecorder()
+					r.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						errs <- fmt.Errorf("query %s: status %d: %s", query, rec.Code, rec.Body)
+						continue
+					}
+					if got := rec.Header().Get("X-Query"); got != want {
+						errs <- fmt.Errorf("query %s: upstream got %s, want %s", query, got, want)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if want := []string{"team-a", "team-b"}; !reflect.DeepEqual(p.namespaces, want) {
+		t.Errorf("namespaces of parser changed to %v, want %v", p.namespaces, want)
+	}
+	if want := (nsparser.Constraints{"cluster": {"c1"}}); !reflect.DeepEqual(p.labels, want) {
+		t.Errorf("label constraints of parser changed to %v, want %v", p.labels, want)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	p := &cachedParser{namespaces: []string{"team-a", "team-b"}}
+	r := newTestRoutes(t, p, &Config{})
+	req := httptest.NewRequest(http.MethodGet, "/-/explain?"+url.Values{"query": {`up{namespace="team-c"} / up`}}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	r.explain(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Status string      `json:"status"`
+		Data   explanation `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := explanation{
+		Upstream:   defaultUpstreamName,
+		Namespaces: []string{"team-a", "team-b"},
+		Query:      `up{namespace="team-c"} / up`,
+		Rewritten:  `up{namespace="` + noDataValue + `"} / up{namespace=~"^team-a$|^team-b$"}`,
+		Selectors: []selectorReport{
+			{
+				Selector:  `up{namespace="team-c"}`,
+				Rewritten: `up{namespace="` + noDataValue + `"}`,
+				Label:     "namespace",
+				NoData:    true,
+				Reasons:   []string{`access denied to namespace "team-c"`},
+			},
+			{
+				Selector:  `up`,
+				Rewritten: `up{namespace=~"^team-a$|^team-b$"}`,
+				Label:     "namespace",
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("got %+v, want %+v", resp.Data, want)
+	}
+
+	r.opts.Config.API.Explain.AdminsOnly = true
+	rec = httptest.NewRecorder()
+	r.explain(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d for user who can not access all namespaces, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestDeniedError(t *testing.T) {
+	p := &cachedParser{namespaces: []string{"c1/team-a", "c2/team-b"}}
+	r := newTestRoutes(t, p, &Config{Enforcement: EnforcementConfig{Denied: deniedError}})
+	cases := map[string]int{
+		//team-a is accessible in c1, so c2 only selects no data
+		`up{namespace="team-a"}`:           http.StatusOK,
+		`up{namespace="team-c"}`:           http.StatusForbidden,
+		`rate(up{namespace="team-c"}[5m])`: http.StatusForbidden,
+	}
+	for query, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d: %s", query, rec.Code, want, rec.Body)
+		}
+	}
+}
+
+func TestDroppedHeader(t *testing.T) {
+	p := &cachedParser{namespaces: []string{"team-a", "team-b"}}
+	r := newTestRoutes(t, p, &Config{Enforcement: EnforcementConfig{Denied: deniedNarrow}})
+	query := `up{namespace=~"team-a|team-c"} / on() group_left() up{namespace=~"team-.*|team-d"}`
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	want := `up{namespace=~"team-a"} / on () group_left () up{namespace=~"^team-a$|^team-b$"}`
+	if got := rec.Header().Get("X-Query"); got != want {
+		t.Errorf("upstream got %s, want %s", got, want)
+	}
+	if got, want := rec.Header().Values(droppedHeader), []string{`namespace="team-c"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got dropped values %q, want %q", got, want)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	var mu sync.Mutex
+	var got url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		got = req.URL.Query()
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":[]}`)
+	}))
+	t.Cleanup(upstream.Close)
+	r := routesTo(t, upstream.URL, &cachedParser{namespaces: []string{"team-a"}}, &Config{})
+	injected := `{namespace="` + noDataValue + `"}`
+	cases := []struct {
+		path string
+		want url.Values
+	}{
+		{"/api/v1/query", url.Values{"query": {injected}}},
+		{"/api/v1/query_range", url.Values{"query": {injected}, "start": {"0"}, "end": {"60"}, "step": {"15"}}},
+		{"/api/v1/query_exemplars", url.Values{"query": {injected}}},
+		{"/api/v1/series", url.Values{"match[]": {injected}}},
+		{"/api/v1/labels", url.Values{"match[]": {injected}}},
+		{"/api/v1/label/__name__/values", url.Values{"match[]": {injected}}},
+	}
+	for _, c := range cases {
+		params := url.Values{
+			"query":   {`{namespace="other"}`},
+			"match[]": {`{namespace="other"}`},
+			"start":   {"0"},
+			"end":     {"60"},
+			"step":    {"15"},
+		}
+		req := httptest.NewRequest(http.MethodGet, c.path+"?"+params.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", c.path, rec.Code, rec.Body)
+			continue
+		}
+		mu.Lock()
+		for _, key := range []string{"query", "match[]"} {
+			if !reflect.DeepEqual(got[key], c.want[key]) {
+				t.Errorf("%s: upstream got %s %q, want %q", c.path, key, got[key], c.want[key])
+			}
+		}
+		mu.Unlock()
+	}
+
+	//label endpoints are restricted without any parameter
+	for _, path := range []string{"/api/v1/labels", "/api/v1/label/__name__/values"} {
+		req := httptest.NewRequest(http.MethodGet, path+"?query=1", nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		mu.Lock()
+		if want := []string{`{namespace=~"^team-a$"}`}; rec.Code != http.StatusOK || !reflect.DeepEqual(got["match[]"], want) || got["query"] != nil {
+			t.Errorf("%s: status %d, upstream got %v, want match[] %q", path, rec.Code, got, want)
+		}
+		mu.Unlock()
+	}
+}
+
+//TestAggregateParamInjection guards against selectors in parameters of aggregations
+//reaching upstream without namespace matcher, e.g. topk(scalar(secret), up)
+func TestCapTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		upstream time.Duration
+		query    url.Values
+		want     url.Values
+	}{
+		{"float seconds within cap", time.Minute, url.Values{"timeout": {"30.5"}}, url.Values{"timeout": {"30.5"}}},
+		{"float seconds over cap", time.Minute, url.Values{"timeout": {"90.5"}}, url.Values{"timeout": {"1m"}}},
+		{"duration within cap", time.Minute, url.Values{"timeout": {"45s"}}, url.Values{"timeout": {"45s"}}},
+		{"duration over cap", time.Minute, url.Values{"timeout": {"1h"}}, url.Values{"timeout": {"1m"}}},
+		{"invalid value", time.Minute, url.Values{"timeout": {"soon"}}, url.Values{"timeout": {"1m"}}},
+		{"absent", time.Minute, url.Values{"query": {"up"}}, url.Values{"query": {"up"}}},
+		{"no upstream timeout", 0, url.Values{"timeout": {"1h"}}, url.Values{"timeout": {"1h"}}},
+	}
+	for _, c := range cases {
+		r := &routes{opts: Options{UpstreamTimeout: c.upstream}}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+c.query.Encode(), nil)
+		r.capTimeout(req)
+		if got := req.URL.Query(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAggregateParamInjection(t *testing.T) {
+	cases := []struct {
+		namespaces []string
+		want       string
+	}{
+		{[]string{"team-a"}, `topk(scalar(sum(secret{namespace=~"^team-a$"})), up{namespace=~"^team-a$"})`},
+		{[]string{"c1/team-a", "c2/team-b"}, `topk(scalar(sum((secret{cluster=~"^c1$",namespace=~"^team-a$"} or secret{cluster=~"^c2$",namespace=~"^team-b$"}))), ` +
+			`(up{cluster=~"^c1$",namespace=~"^team-a$"} or up{cluster=~"^c2$",namespace=~"^team-b$"}))`},
+	}
+	for _, c := range cases {
+		r := newTestRoutes(t, &cachedParser{namespaces: c.namespaces}, &Config{})
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {`topk(scalar(sum(secret)), up)`}}.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Query"); rec.Code != http.StatusOK || got != c.want {
+			t.Errorf("%v: status %d, upstream got %s, want %s", c.namespaces, rec.Code, got, c.want)
+		}
+	}
+}
+
+func TestExperimentalFunctionsDisabled(t *testing.T) {
+	promparser.EnableExperimentalFunctions = false
+	defer func() { promparser.EnableExperimentalFunctions = true }()
+	r := newTestRoutes(t, &cachedParser{namespaces: []string{"team-a"}}, &Config{})
+	for _, query := range []string{`info(up)`, `limitk(2, up)`} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("X-Query") != "" {
+			t.Errorf("%s: got status %d, upstream got %q, want status %d", query, rec.Code, rec.Header().Get("X-Query"), http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	promparser "github.com/prometheus/prometheus/promql/parser"
+)
+
+//alerts returns alerts whose namespace label is accessible to the caller
+func (r *routes) alerts(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	up := r.upstreamFor(req)
+	if s.unrestricted() {
+		up.handler.ServeHTTP(w, req)
+		return
+	}
+	filterResponse(w, req, up, func(data interface{}) interface{} {
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return data
+		}
+		obj["alerts"] = filterItems(obj["alerts"], func(alert map[string]interface{}) bool {
+			return s.allows(up.nsLabelName, labelsOf(alert["labels"]))
+		})
+		return obj
+	})
+}
+
+//rules returns rules whose queries only select namespaces accessible to the caller.
+//Rule groups without such rules are removed
+func (r *routes) rules(w http.ResponseWriter, req *http.Request) {
+	s := r.scope(w, req)
+	if s == nil {
+		return
+	}
+	up := r.upstreamFor(req)
+	if s.unrestricted() {
+		up.handler.ServeHTTP(w, req)
+		return
+	}
+	showUnscoped := r.opts.Config.API.ShowUnscopedRules
+	filterResponse(w, req, up, func(data interface{}) interface{} {
+		obj, ok := data.(map[string]interface{})
+		if !ok {
+			return data
+		}
+		obj["groups"] = filterItems(obj["groups"], func(group map[string]interface{}) bool {
+			rules := filterItems(group["rules"], func(rule map[string]interface{}) bool {
+				query, _ := rule["query"].(string)
+				if !ruleAllowed(query, up.nsLabelName, s, showUnscoped) {
+					return false
+				}
+				if _, ok := rule["alerts"]; ok {
+					rule["alerts"] = filterItems(rule["alerts"], func(alert map[string]interface{}) bool {
+						return s.allows(up.nsLabelName, labelsOf(alert["labels"]))
+					})
+				}
+				return true
+			})
+			group["rules"] = rules
+			return len(rules) > 0
+		})
+		return obj
+	})
+}
+
+//ruleAllowed tells whether query of rule only selects namespaces and values of
+//constrained labels accessible to the caller
+func ruleAllowed(query string, nsLabelName string, s *scope, showUnscoped bool) bool {
+	if !isAllNamespaces(s.namespaces) {
+		selected, scoped := queryNamespaces(query, nsLabelName)
+		if !scoped && !showUnscoped {
+			return false
+		}
+		//namespaces qualified by cluster are only allowed if query selects the cluster
+		clusters, clusterScoped := queryNamespaces(query, s.clusterLabel)
+		if !clusterScoped {
+			clusters = []string{""}
+		}
+		for _, cluster := range clusters {
+			for _, ns := range selected {
+				if !s.allowsNamespace(cluster, ns) {
+					return false
+				}
+			}
+		}
+	}
+	for name, values := range s.labels {
+		selected, scoped := queryNamespaces(query, name)
+		if !scoped {
+			if !showUnscoped {
+				return false
+			}
+			continue
+		}
+		for _, v := range selected {
+			if !contains(values, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//queryNamespaces returns namespaces selected by query. The scope of query can only be
+//determined if every selector has namespace matcher in one of the formats supported
+//by enforceLabelMatcher, otherwise false is returned
+func queryNamespaces(query string, nsLabelName string) ([]string, bool) {
+	expr, err := promparser.ParseExpr(query)
+	if err != nil {
+		return nil, false
+	}
+	var selected []string
+	scoped := true
+	promparser.Inspect(expr, func(node promparser.Node, _ []promparser.Node) error {
+		vs, ok := node.(*promparser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		var nsMatcher *promlabels.Matcher
+		for _, m := range vs.LabelMatchers {
+			if m.Name == nsLabelName {
+				nsMatcher = m
+			}
+		}
+		switch {
+		case nsMatcher == nil:
+			scoped = false
+		case nsMatcher.Type == promlabels.MatchEqual:
+			selected = append(selected, nsMatcher.Value)
+		case nsMatcher.Type == promlabels.MatchRegexp:
+			selected = append(selected, strings.Split(nsMatcher.Value, "|")...)
+		default:
+			scoped = false
+		}
+		return nil
+	})
+	return selected, scoped
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/IBM/ibm-grafana-ocpthanos-proxy/pkg/nsparser"
+)
+
+//scope is the data accessible to the caller
+type scope struct {
+	//namespaces accessible to the caller. It holds nsparser.AllNamespaces if all are accessible
+	namespaces []string
+	//labels restricts labels besides namespace label, e.g. cluster. It is empty for most namespace parsers
+	labels nsparser.Constraints
+	//clusterLabel carries cluster of cluster-qualified namespaces, e.g. cluster1/team-a
+	clusterLabel string
+}
+
+//scope gets the data accessible to the caller. If there is none, error is responded and nil is returned
+func (r *routes) scope(w http.ResponseWriter, req *http.Request) *scope {
+	namespaces, ok := r.namespaces(w, req)
+	if !ok {
+		return nil
+	}
+	s := &scope{namespaces: namespaces, clusterLabel: r.opts.Config.Enforcement.clusterLabel()}
+	if p, ok := r.nsparser.(nsparser.ConstraintParser); ok {
+		labels, err := p.ParseConstraints(req)
+		if err != nil {
+			http.Error(w, "No label constraint for user. details: "+err.Error(), http.StatusForbidden)
+			return nil
+		}
+		s.labels = labels
+	}
+	return s
+}
+
+//unrestricted tells whether the caller can access data of all tenants
+func (s *scope) unrestricted() bool {
+	return isAllNamespaces(s.namespaces) && len(s.labels) == 0
+}
+
+//allows tells whether series is accessible to the caller. value returns value of label of the series.
+//Empty nsLabelName means namespace of series is not restricted, e.g. by bypass rule, but its cluster is
+func (s *scope) allows(nsLabelName string, value func(name string) string) bool {
+	switch {
+	case isAllNamespaces(s.namespaces):
+	case nsLabelName == "":
+		if !s.allowsCluster(value(s.clusterLabel)) {
+			return false
+		}
+	case !s.allowsNamespace(value(s.clusterLabel), value(nsLabelName)):
+		return false
+	}
+	for name, values := range s.labels {
+		if !contains(values, value(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+//labelNames returns names of constrained labels besides namespace label in stable order
+func (s *scope) labelNames() []string {
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//key identifies the scope, e.g. in limiter and cache keys
+func (s *scope) key() string {
+	parts := []string{sortedJoin(s.namespaces)}
+	for _, name := range s.labelNames() {
+		parts = append(parts, name+"="+sortedJoin(s.labels[name]))
+	}
+	return strings.Join(parts, ";")
+}
+
+func sortedJoin(values []string) string {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
@@ -0,0 +1,105 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+//evalRange evaluates range query over [start, end]. If splitting is enabled,
+//the range is split into interval-aligned sub-queries which run in parallel
+func (r *routes) evalRange(ctx context.Context, up *upstream, params url.Values, start, end, step model.Time) (*rangeResult, error) {
+	cfg := r.opts.Config.Split
+	interval := model.Time(time.Duration(cfg.Interval) / time.Millisecond)
+	if interval <= 0 {
+		return fetchRange(ctx, up, params, start, end)
+	}
+	parts := splitRange(start, end, step, interval)
+	if len(parts) == 1 {
+		return fetchRange(ctx, up, params, start, end)
+	}
+	maxParallel := cfg.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = 4
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	results := make([]*rangeResult, len(parts))
+	slots := make(chan struct{}, maxParallel)
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part [2]model.Time) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			res, err := fetchRange(ctx, up, params, part[0], part[1])
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			results[i] = res
+		}(i, part)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	//sub-queries waiting for a slot are skipped once the request is cancelled
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mergeResults(results...), nil
+}
+
+//splitRange splits [start, end] at multiples of interval. Every part starts
+//at a point evaluated by the original query, so that merged result is the same
+//unless query uses @ start() or @ end(), which is not split for that reason
+func splitRange(start, end, step, interval model.Time) [][2]model.Time {
+	var parts [][2]model.Time
+	for s := start; s <= end; {
+		next := (s/interval + 1) * interval
+		e := start + (next-1-start)/step*step
+		if e < s {
+			e = s
+		}
+		if e > end {
+			e = end
+		}
+		parts = append(parts, [2]model.Time{s, e})
+		s = e + step
+	}
+	return parts
+}
@@ -0,0 +1,247 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//defaultUpstreamName is the name of upstream configured by command line options
+const defaultUpstreamName = "default"
+
+//upstream is a thanos-querier or prometheus service which requests are forwarded to
+type upstream struct {
+	name        string
+	url         *url.URL
+	tokenFile   string
+	nsLabelName string
+	//handler is instance of httputil.ReverseProxy
+	handler http.Handler
+	//transport sends requests to endpoints of the upstream
+	transport http.RoundTripper
+}
+
+//newUpstream creates upstream and its reverse proxy
+func newUpstream(cfg UpstreamConfig, opts Options) (*upstream, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url of upstream %s: %v", cfg.Name, err)
+	}
+	up := &upstream{
+		name:        cfg.Name,
+		url:         u,
+		tokenFile:   cfg.TokenFile,
+		nsLabelName: cfg.NSLabelName,
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	// it is http.DefaultTransport with response header timeout and extra tls Config
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: opts.UpstreamResponseHeaderTimeout,
+	}
+	failover := &failoverTransport{
+		upstream:  cfg.Name,
+		transport: transport,
+		retries:   cfg.Retries,
+		backoff:   time.Duration(cfg.RetryBackoff),
+	}
+	if failover.backoff <= 0 {
+		failover.backoff = 100 * time.Millisecond
+	}
+	for _, addr := range append([]string{cfg.URL}, cfg.Replicas...) {
+		epURL, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replica url of upstream %s: %v", cfg.Name, err)
+		}
+		if epURL.Scheme == "https" && transport.TLSClientConfig == nil {
+			if transport.TLSClientConfig, err = newTLSConfig(cfg.TLS); err != nil {
+				return nil, fmt.Errorf("invalid tls settings of upstream %s: %v", cfg.Name, err)
+			}
+		}
+		failover.endpoints = append(failover.endpoints, &endpoint{url: epURL, healthy: 1})
+	}
+	if cfg.HealthCheckPath != "" {
+		interval := time.Duration(cfg.HealthCheckInterval)
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		go failover.healthCheck(cfg.HealthCheckPath, interval, up.director)
+	}
+	log.Printf("upstream %s created with %d endpoint(s)", cfg.Name, len(failover.endpoints))
+	up.transport = failover
+	proxy.Transport = failover
+	proxy.Director = up.director
+	up.handler = proxy
+	return up, nil
+}
+
+//director updates request URL and Host, and adds access token of the upstream
+func (up *upstream) director(req *http.Request) {
+	req.URL.Scheme = up.url.Scheme
+	req.URL.Host = up.url.Host
+	//update Host so that it can pass OCP Router when testing locally
+	req.Host = up.url.Host
+	targetQuery := up.url.RawQuery
+	req.URL.Path = singleJoiningSlash(up.url.Path, req.URL.Path)
+	if targetQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = targetQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+	if up.tokenFile == "" {
+		return
+	}
+	//add Authorization heander for token
+	tokenBytes, err := ioutil.ReadFile(up.tokenFile)
+	if err != nil {
+		tokenBytes = []byte("")
+	}
+	thanosToken := string(tokenBytes)
+	req.Header.Set("Authorization", "Bearer "+thanosToken)
+}
+
+//mergeUpstreamConfig overrides settings of upstream configured by command line options
+//with the ones listed in configuration file
+func mergeUpstreamConfig(base UpstreamConfig, cfg UpstreamConfig) UpstreamConfig {
+	if cfg.URL != "" {
+		base.URL = cfg.URL
+	}
+	if cfg.TokenFile != "" {
+		base.TokenFile = cfg.TokenFile
+	}
+	if cfg.NSLabelName != "" {
+		base.NSLabelName = cfg.NSLabelName
+	}
+	if cfg.TLS != (TLSConfig{}) {
+		base.TLS = cfg.TLS
+	}
+	base.Replicas = cfg.Replicas
+	base.Retries = cfg.Retries
+	base.RetryBackoff = cfg.RetryBackoff
+	base.HealthCheckPath = cfg.HealthCheckPath
+	base.HealthCheckInterval = cfg.HealthCheckInterval
+	return base
+}
+
+//do sends request created by the proxy itself to upstream
+func (up *upstream) do(req *http.Request) (*http.Response, error) {
+	up.director(req)
+	return up.transport.RoundTrip(req)
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+//upstreamFor picks upstream for the request by routing rules.
+//The first matching rule wins and the default upstream is used if none matches
+func (r *routes) upstreamFor(req *http.Request) *upstream {
+	for _, rule := range r.opts.Config.Routing {
+		if ruleMatches(rule, req) {
+			return r.upstreams[rule.Upstream]
+		}
+	}
+	return r.upstreams[defaultUpstreamName]
+}
+
+//ruleMatches tells whether request meets all conditions of the rule
+func ruleMatches(rule RoutingRule, req *http.Request) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if rule.Header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(rule.Header)]
+		if !ok {
+			return false
+		}
+		if rule.HeaderValue != "" && !contains(values, rule.HeaderValue) {
+			return false
+		}
+	}
+	if rule.OlderThan > 0 && !queryStart(req).Before(time.Now().Add(-time.Duration(rule.OlderThan))) {
+		return false
+	}
+	return true
+}
+
+//queryStart returns the earliest time the request asks data for
+func queryStart(req *http.Request) time.Time {
+	param := "start"
+	if strings.HasSuffix(req.URL.Path, "/query") {
+		param = "time"
+	}
+	if t, err := parseTime(req.FormValue(param)); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+//
+// Copyright 2020 IBM Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFor(t *testing.T) {
+	longterm := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(longterm.Close)
+	cfg := &Config{
+		Upstreams: []UpstreamConfig{{Name: "longterm", URL: longterm.URL}},
+		Routing: []RoutingRule{
+			{Upstream: defaultUpstreamName, Header: "X-Upstream", HeaderValue: "default"},
+			{Upstream: "longterm", OlderThan: Duration(14 * 24 * time.Hour)},
+			{Upstream: "longterm", PathPrefix: "/api/v1/series"},
+		},
+	}
+	r := newTestRoutes(t, &cachedParser{namespaces: []string{"team-a"}}, cfg)
+	ago := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(-d).Unix(), 10)
+	}
+	cases := []struct {
+		name   string
+		path   string
+		params url.Values
+		header string
+		want   string
+	}{
+		{"recent range", "/api/v1/query_range", url.Values{"start": {ago(time.Hour)}}, "", defaultUpstreamName},
+		{"old range", "/api/v1/query_range", url.Values{"start": {ago(30 * 24 * time.Hour)}}, "", "longterm"},
+		{"old range in RFC3339", "/api/v1/query_range",
+			url.Values{"start": {time.Now().Add(-30 * 24 * time.Hour).UTC().Format(time.RFC3339)}}, "", "longterm"},
+		{"recent instant", "/api/v1/query", url.Values{"time": {ago(time.Hour)}}, "", defaultUpstreamName},
+		{"old instant", "/api/v1/query", url.Values{"time": {ago(15 * 24 * time.Hour)}}, "", "longterm"},
+		{"instant without time", "/api/v1/query", url.Values{}, "", defaultUpstreamName},
+		{"invalid start", "/api/v1/query_range", url.Values{"start": {"x"}}, "", defaultUpstreamName},
+		{"path prefix", "/api/v1/series", url.Values{}, "", "longterm"},
+		{"header wins", "/api/v1/query_range", url.Values{"start": {ago(30 * 24 * time.Hour)}}, "default", defaultUpstreamName},
+		{"other header value", "/api/v1/query_range", url.Values{"start": {ago(30 * 24 * time.Hour)}}, "x", "longterm"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path+"?"+c.params.Encode(), nil)
+		if c.header != "" {
+			req.Header.Set("X-Upstream", c.header)
+		}
+		if got := r.upstreamFor(req).name; got != c.want {
+			t.Errorf("%s: got upstream %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+//countingServer responds with status and counts the requests it receives
+func countingServer(t *testing.T, status int, count *int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(count, 1)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"status":"success","data":[]}`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestFailover(t *testing.T) {
+	var okCount, failCount int32
+	ok := countingServer(t, http.StatusOK, &okCount)
+	failing := countingServer(t, http.StatusServiceUnavailable, &failCount)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		name     string
+		replicas []string
+		retries  int
+		method   string
+		path     string
+		//failures is the number of requests expected to fail out of 4
+		failures int
+	}{
+		{"retry on 5xx", []string{failing.URL}, 1, http.MethodGet, "/api/v1/query", 0},
+		{"retry on connection error", []string{closed.URL}, 1, http.MethodGet, "/api/v1/query", 0},
+		{"retry on both", []string{failing.URL, closed.URL}, 2, http.MethodGet, "/api/v1/query", 0},
+		{"no retry", []string{failing.URL}, 0, http.MethodGet, "/api/v1/query", 2},
+		{"POST read is retried", []string{failing.URL}, 1, http.MethodPost, "/api/v1/query", 0},
+		{"admin API is not retried", []string{failing.URL}, 1, http.MethodPost, "/api/v1/admin/tsdb/snapshot", 2},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&okCount, 0)
+		atomic.StoreInt32(&failCount, 0)
+		up, err := newUpstream(UpstreamConfig{
+			Name:         "test",
+			URL:          ok.URL,
+			Replicas:     c.replicas,
+			Retries:      c.retries,
+			RetryBackoff: Duration(time.Millisecond),
+		}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failures := 0
+		for i := 0; i < 4; i++ {
+			req, err := http.NewRequest(c.method, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := up.do(req)
+			if err != nil {
+				failures++
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				failures++
+			}
+		}
+		//endpoints are tried in turn, so half of the requests go to the replica first
+		if len(c.replicas) == 1 && failures != c.failures {
+			t.Errorf("%s: %d of 4 requests failed, want %d", c.name, failures, c.failures)
+		}
+		if len(c.replicas) > 1 && failures > c.failures {
+			t.Errorf("%s: %d of 4 requests failed, want at most %d", c.name, failures, c.failures)
+		}
+		if got := atomic.LoadInt32(&okCount); int(got) != 4-failures {
+			t.Errorf("%s: healthy endpoint got %d requests, want %d", c.name, got, 4-failures)
+		}
+	}
+}
+
+func TestFailoverHealthCheck(t *testing.T) {
+	var okCount, failCount int32
+	ok := countingServer(t, http.StatusOK, &okCount)
+	failing := countingServer(t, http.StatusServiceUnavailable, &failCount)
+	up, err := newUpstream(UpstreamConfig{
+		Name:                "test",
+		URL:                 failing.URL,
+		Replicas:            []string{ok.URL},
+		HealthCheckPath:     "/-/healthy",
+		HealthCheckInterval: Duration(time.Millisecond),
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := up.transport.(*failoverTransport).endpoints
+	deadline := time.Now().Add(5 * time.Second)
+	for endpoints[0].isHealthy() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if endpoints[0].isHealthy() || !endpoints[1].isHealthy() {
+		t.Fatalf("health of endpoints is %v and %v, want false and true", endpoints[0].isHealthy(), endpoints[1].isHealthy())
+	}
+	//unhealthy endpoint is only tried after the healthy one, so no retry is needed
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		resp, err := up.do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+}